@@ -8,37 +8,357 @@
 
 // Print all primes <= n, where n := flag.Arg(0).
 // If the flag -n is given, it will print the nth prime only.
+// If the flag -start is given, primes less than it are skipped.
+// If the flag -count is given, it will print that many primes and n is unused.
+// If the flag -test is given, it will print whether each argument is prime
+// and exit with status 0 only if all of them are.
+// If the flag -factor is given, it will print the prime factorization
+// of each argument instead.
+// If the flag -reverse is given, the primes are printed in descending order.
+// The flag -format selects the output format: "text" prints one prime per
+// line, "jsonl" prints one JSON object like {"index":1,"prime":2} per line.
+// If the flag -http is given, it will serve primes over HTTP on that address.
+// If the flag -mem is given, the heap memory in use is reported on stderr
+// when done.
+// If the flag -gaps is given, it will print the frequency of each gap size
+// between consecutive primes <= n instead.
+// If the flag -cols is given, the primes are printed that many per line,
+// right-aligned to a common width.
+// If the flag -rank is given, each prime is prefixed with its index, as in
+// "1: 2"; the jsonl format always includes it.
+// If the flag -countonly is given, it will print the number of primes <= n
+// instead.
+// If the flag -tee is given, the output is also written to that file.
 
 package main
 
 import (
+	"bufio"
 	"container/ring"
 	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"iter"
+	"math"
+	"math/big"
+	"math/bits"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var nth = flag.Bool("n", false, "print the nth prime only")
-var nCPU = flag.Int("ncpu", 1, "number of CPUs to use")
+var nCPU = flag.Int("ncpu", 1, "number of CPUs to use, 0 for all of them")
+var start = flag.Int("start", 2, "skip primes less than start")
+var count = flag.Int("count", 0, "print the first count primes only")
+var test = flag.Bool("test", false, "test whether the arguments are prime")
+var factor = flag.Bool("factor", false, "factorize the arguments")
+var reverse = flag.Bool("reverse", false, "print primes in descending order")
+var format = flag.String("format", "text", "output format: text or jsonl")
+var httpAddr = flag.String("http", "", "serve primes over HTTP on this address")
+var mem = flag.Bool("mem", false, "report heap memory in use on exit")
+var histogram = flag.Bool("gaps", false, "print a histogram of prime gaps")
+var cols = flag.Int("cols", 0, "print this many primes per line")
+var rank = flag.Bool("rank", false, "prefix each prime with its index")
+var countonly = flag.Bool("countonly", false, "print the number of primes <= n only")
+var tee = flag.String("tee", "", "also write the output to this file")
 
-// Wheel to quickly generate numbers coprime to 2, 3, 5 and 7.
-// Starting from 13, we successively add wheel[i] to get 17, 19, 23, ...
-var wheel = []int{
-	4, 2, 4, 6, 2, 6, 4, 2, 4, 6, 6, 2, 6, 4, 2, 6, 4, 6, 8, 4, 2, 4, 2, 4, 8,
-	6, 4, 6, 2, 4, 6, 2, 6, 6, 4, 2, 4, 6, 2, 6, 4, 2, 4, 2, 10, 2, 10, 2,
+// Wheel to quickly generate numbers coprime to some basis primes.
+// For the basis 2, 3, 5 and 7, starting from 13 we successively add
+// gaps[i] = 4, 2, 4, 6, 2, 6, 4, 2, 4, 6, ... to get 17, 19, 23, 29, ...
+// and pos maps (p % 210) to a corresponding wheel position, since a prime
+// number can only be one of these values (mod 210).
+type wheel struct {
+	basis []int // the smallest consecutive primes
+	prime int   // the smallest prime not in basis
+	first int   // the smallest number > prime coprime to basis
+	gaps  []int // successive gaps between numbers coprime to basis
+	pos   []int // pos[n % product of basis] is the index in gaps after n
 }
 
-// Return a chan int of values (n + k * wheel[i]) for successive i.
-func spin(n, k, i, bufsize int) chan int {
+var wheel2357 = newWheel([]int{2, 3, 5, 7})
+
+// Return the wheel for the given basis primes.
+func newWheel(basis []int) *wheel {
+	mod := 1
+	for _, b := range basis {
+		mod *= b
+	}
+	w := &wheel{basis: basis, prime: 2, pos: make([]int, mod)}
+	for !w.coprime(w.prime) {
+		w.prime++
+	}
+	w.first = w.next(w.prime)
+	for n, m := w.first, w.first+1; m <= w.first+mod; m++ {
+		if w.coprime(m) {
+			w.pos[n%mod] = len(w.gaps)
+			w.gaps = append(w.gaps, m-n)
+			n = m
+		}
+	}
+	return w
+}
+
+// Report whether n is coprime to the basis primes.
+func (w *wheel) coprime(n int) bool {
+	for _, b := range w.basis {
+		if n%b == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the smallest number > n coprime to the basis primes.
+func (w *wheel) next(n int) int {
+	n++
+	for !w.coprime(n) {
+		n++
+	}
+	return n
+}
+
+// Report whether n is coprime to 2, 3, 5 and 7.
+func CoprimeTo210(n int) bool { return wheel2357.coprime(n) }
+
+// Return the position of n in the 2, 3, 5, 7 wheel, counting from 13 at 0,
+// such that the gap from n to the next number coprime to 210 is the one at
+// that position, and whether n is coprime to 210 and so on the wheel.
+// WheelIndex(13) -> 0, true
+// WheelIndex(17) -> 1, true
+// WheelIndex(223) -> 0, true
+func WheelIndex(n int) (int, bool) {
+	if !CoprimeTo210(n) {
+		return 0, false
+	}
+	mod := len(wheel2357.pos)
+	return wheel2357.pos[(n%mod+mod)%mod], true
+}
+
+// A Logger is notified at key points in the life of a sieve:
+//
+//	"spin"       a wheel generator started at n
+//	"multiples"  a generator of multiples of the prime n was created
+//	"heap"       the merging heap grew to n channels
+//	"sendproxy"  the proxy buffer was expanded to n elements
+//	"exit"       a goroutine returned after its sieve was stopped
+type Logger interface {
+	Log(event string, n int)
+}
+
+// The default Logger, which discards all events.
+type nopLogger struct{}
+
+func (nopLogger) Log(event string, n int) {}
+
+// Options for SieveWith.  The zero value gives the same sieve as Sieve().
+type Config struct {
+	Logger       Logger // if nil, events are discarded
+	Bufsize      int    // buffer size of the generator channels
+	CompositeBuf int    // buffer size of the channel of composites
+	MultiplesBuf int    // buffer size of each channel of multiples
+	WheelPrimes  []int  // basis primes of the wheel; default 2, 3, 5 and 7
+
+	// If positive, at most this many goroutines generate multiples; the
+	// multiples of later primes are derived by the merger itself.
+	MaxLiveMultiples int
+
+	// If set, the time the merger, the sieve and sendproxy spend not
+	// blocked on channels is measured, for Generator.Timings.
+	Timed bool
+
+	// If set, the primes whose multiples are eliminated are received from
+	// BasePrimes, in increasing order from the smallest prime not in
+	// WheelPrimes, instead of being fed back from the sieve's own output.
+	// The channel must not be closed while the sieve runs, and must supply
+	// every prime <= sqrt(p) before the sieve can output the prime p.
+	BasePrimes <-chan int
+
+	// If set, the sieve outputs only the primes among the increasing
+	// values received from Candidates, rather than all primes.  The base
+	// primes then come from a second sieve, unless BasePrimes is set.
+	Candidates <-chan int
+
+	wheel *wheel
+}
+
+// The largest product of WheelPrimes; the wheel keeps a table that long.
+const maxWheel = 1 << 24
+
+// Return an error describing the first nonsensical option in c, if any.
+func (c Config) validate() error {
+	if c.Bufsize < 0 {
+		return fmt.Errorf("bad config: negative Bufsize %d", c.Bufsize)
+	}
+	if c.CompositeBuf < 0 {
+		return fmt.Errorf("bad config: negative CompositeBuf %d", c.CompositeBuf)
+	}
+	if c.MultiplesBuf < 0 {
+		return fmt.Errorf("bad config: negative MultiplesBuf %d", c.MultiplesBuf)
+	}
+	if c.MaxLiveMultiples < 0 {
+		return fmt.Errorf("bad config: negative MaxLiveMultiples %d", c.MaxLiveMultiples)
+	}
+	mod := 1
+	for i, b := range c.WheelPrimes {
+		if i >= len(smallPrimes) || b != smallPrimes[i] {
+			return fmt.Errorf("bad config: WheelPrimes %v are not the smallest consecutive primes", c.WheelPrimes)
+		}
+		if mod *= b; mod > maxWheel {
+			return fmt.Errorf("bad config: WheelPrimes %v make a wheel larger than %d", c.WheelPrimes, maxWheel)
+		}
+	}
+	return nil
+}
+
+// Return a copy of c with unset options replaced by their defaults.
+// The default buffer sizes grow with the logarithm of GOMAXPROCS, so that
+// on many-core machines the pipeline has enough slack to keep busy.
+func (c Config) withDefaults() *Config {
+	scale := bits.Len(uint(runtime.GOMAXPROCS(0)))
+	if c.Logger == nil {
+		c.Logger = nopLogger{}
+	}
+	if c.Bufsize == 0 {
+		c.Bufsize = 1024 * scale
+	}
+	if c.CompositeBuf == 0 {
+		c.CompositeBuf = 8046 * scale
+	}
+	if c.MultiplesBuf == 0 {
+		c.MultiplesBuf = 16
+	}
+	if c.WheelPrimes == nil {
+		c.wheel = wheel2357
+	} else {
+		c.wheel = newWheel(c.WheelPrimes)
+	}
+	return &c
+}
+
+// The value with which send and recv panic to unwind a goroutine
+// whose sieve has been stopped.
+type stopped struct{}
+
+// Send v to ch, or unwind the calling goroutine if done is closed first.
+// The first non-blocking attempt is much cheaper than the two-way select.
+func send[T any](ch chan<- T, v T, done <-chan struct{}) {
+	select {
+	case ch <- v:
+		return
+	default:
+	}
+	select {
+	case ch <- v:
+	case <-done:
+		panic(stopped{})
+	}
+}
+
+// Receive from ch, or unwind the calling goroutine if done is closed first.
+func recv[T any](ch <-chan T, done <-chan struct{}) T {
+	select {
+	case v := <-ch:
+		return v
+	default:
+	}
+	select {
+	case v := <-ch:
+		return v
+	case <-done:
+		panic(stopped{})
+	}
+}
+
+// Like recv, but also report whether ch is still open, as v, ok := <-ch.
+func recvOK[T any](ch <-chan T, done <-chan struct{}) (T, bool) {
+	select {
+	case v, ok := <-ch:
+		return v, ok
+	case <-done:
+		panic(stopped{})
+	}
+}
+
+// Deferred by every goroutine of a sieve, or of a stream built on one,
+// to end the unwinding started by send or recv.
+func exit(log Logger) {
+	if e := recover(); e != nil {
+		if _, ok := e.(stopped); !ok {
+			panic(e)
+		}
+		log.Log("exit", 0)
+	}
+}
+
+// A stopwatch adding to total the time a goroutine is not blocked on its
+// channels.  It is off, and costs next to nothing, if total is nil.
+type stopwatch struct {
+	total *atomic.Int64
+	since time.Time
+}
+
+func (s *stopwatch) start() {
+	if s.total != nil {
+		s.since = time.Now()
+	}
+}
+
+func (s *stopwatch) stop() {
+	if s.total != nil {
+		s.total.Add(int64(time.Since(s.since)))
+	}
+}
+
+// Like recv and send, but stopping s while blocked.
+func (s *stopwatch) recv(ch <-chan int, done <-chan struct{}) int {
+	s.stop()
+	v := recv(ch, done)
+	s.start()
+	return v
+}
+
+func (s *stopwatch) send(ch chan<- int, v int, done <-chan struct{}) {
+	s.stop()
+	send(ch, v, done)
+	s.start()
+}
+
+// Return a stopwatch adding to ps.busy[phase] if conf.Timed, started.
+func newStopwatch(conf *Config, ps *pipes, phase int) *stopwatch {
+	s := &stopwatch{}
+	if conf.Timed {
+		s.total = &ps.busy[phase]
+	}
+	s.start()
+	return s
+}
+
+// Return a chan int of values (n + k * gaps[i]) for successive i.
+// The goroutine exits when done is closed.
+func spin(n, k, i int, gaps []int, bufsize int, log Logger, done <-chan struct{}) chan int {
 	out := make(chan int, bufsize)
 	go func() {
+		defer exit(log)
+		log.Log("spin", n)
 		for {
-			for ; i < 48; i++ {
-				out <- n
-				n += k * wheel[i]
+			for ; i < len(gaps); i++ {
+				send(out, n, done)
+				n += k * gaps[i]
 			}
 			i = 0
 		}
@@ -46,30 +366,79 @@ func spin(n, k, i, bufsize int) chan int {
 	return out
 }
 
-// Return a chan of numbers coprime to 2, 3, 5 and 7, starting from 13.
-// coprime2357() -> 13, 17, 19, 23, 25, 31, 35, 37, 41, 47, ...
-func coprime2357() chan int { return spin(13, 1, 0, 1024) }
+// Return a chan of numbers coprime to the basis primes of the wheel,
+// starting after the smallest prime not in the basis.
+// For the basis 2, 3, 5 and 7:
+// coprimes() -> 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, ...
+func coprimes(c *Config, done <-chan struct{}) chan int {
+	return spin(c.wheel.first, 1, 0, c.wheel.gaps, c.Bufsize, c.Logger, done)
+}
+
+// Return a chan of the values received from src that the sieve can tell
+// apart: those coprime to the basis primes, and the basis primes.
+func wheelCandidates(src <-chan int, c *Config, done <-chan struct{}) chan int {
+	out := make(chan int, c.Bufsize)
+	go func() {
+		defer exit(c.Logger)
+		for {
+			select {
+			case n, ok := <-src:
+				if !ok {
+					src = nil // no more candidates
+				} else if n >= 2 && (c.wheel.coprime(n) || slices.Contains(c.wheel.basis, n)) {
+					send(out, n, done)
+				}
+			case <-done:
+				panic(stopped{})
+			}
+		}
+	}()
+	return out
+}
+
+// Return the chan of candidates the sieve starts from, before any
+// composites are eliminated.
+// Candidates() -> 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, ...
+func Candidates() <-chan int { return candidates(nil) }
 
-// Map (p % 210) to a corresponding wheel position.
-// A prime number can only be one of these value (mod 210).
-var wheelpos = map[int]int{
-	1: 46, 11: 47, 13: 0, 17: 1, 19: 2, 23: 3, 29: 4, 31: 5, 37: 6, 41: 7,
-	43: 8, 47: 9, 53: 10, 59: 11, 61: 12, 67: 13, 71: 14, 73: 15, 79: 16,
-	83: 17, 89: 18, 97: 19, 101: 20, 103: 21, 107: 22, 109: 23, 113: 24,
-	121: 25, 127: 26, 131: 27, 137: 28, 139: 29, 143: 30, 149: 31, 151: 32,
-	157: 33, 163: 34, 167: 35, 169: 36, 173: 37, 179: 38, 181: 39, 187: 40,
-	191: 41, 193: 42, 197: 43, 199: 44, 209: 45,
+// Like Candidates(), but the generator exits once done is closed.
+func candidates(done <-chan struct{}) chan int {
+	return coprimes(Config{}.withDefaults(), done)
 }
 
 // Return a chan of multiples of a prime p that are relative prime
-// to 2, 3, 5 and 7, starting from (p * p).
+// to the basis primes of the wheel, starting from (p * p).
+// For the basis 2, 3, 5 and 7:
 // multiples(11) -> 121, 143, 187, 209, 253, 319, 341, 407, 451, 473, ...
 // multiples(13) -> 169, 221, 247, 299, 377, 403, 481, 533, 559, 611, ...
-func multiples(p int) chan int { return spin(p*p, p, wheelpos[p%210], 1024) }
+func multiples(p int, c *Config, done <-chan struct{}) chan int {
+	c.Logger.Log("multiples", p)
+	return multiplesFrom(p, p, c, done)
+}
+
+// Like multiples(p), but starting from (p * k), where k is coprime to the
+// basis primes of the wheel.
+func multiplesFrom(p, k int, c *Config, done <-chan struct{}) chan int {
+	w := c.wheel
+	return spin(p*k, p, w.pos[k%len(w.pos)], w.gaps, c.MultiplesBuf, c.Logger, done)
+}
 
 type PeekCh struct {
 	head int
-	ch   chan int
+	ch   chan int // nil if the multiples are derived in place
+	p, i int      // the prime, and the wheel index of the next multiple
+}
+
+// Advance c to the next multiple, received from c.ch if there is one.
+func (c *PeekCh) advance(gaps []int, sw *stopwatch, done <-chan struct{}) {
+	if c.ch != nil {
+		c.head = sw.recv(c.ch, done)
+		return
+	}
+	c.head += c.p * gaps[c.i]
+	if c.i++; c.i == len(gaps) {
+		c.i = 0
+	}
 }
 
 // Heap of PeekCh, sorting by head values.
@@ -101,11 +470,15 @@ func (h *PeekChHeap) Push(v interface{}) {
 // in an expanding buffer, so that sending to `out` never blocks.
 // See this discussion:
 // <http://rogpeppe.wordpress.com/2010/02/10/unlimited-buffering-with-low-overhead>
-func sendproxy(out chan<- int) chan<- int {
+// The goroutine exits when done is closed, leaving the buffer in ps.
+func sendproxy(out chan<- int, ps *pipes, conf *Config, done <-chan struct{}) chan<- int {
 	proxy := make(chan int, 1024)
 	go func() {
-		n := 1024 // the allocated size of the circular queue
-		first := ring.New(n)
+		defer ps.wg.Done()
+		log := conf.Logger
+		sw := newStopwatch(conf, ps, sendproxyPhase)
+		first := ps.ring
+		n := first.Len() // the allocated size of the circular queue
 		last := first
 		var c chan<- int
 		var e int
@@ -117,6 +490,7 @@ func sendproxy(out chan<- int) chan<- int {
 			} else {
 				e = first.Value.(int)
 			}
+			sw.stop()
 			select {
 			case e = <-proxy:
 				last.Value = e
@@ -124,11 +498,17 @@ func sendproxy(out chan<- int) chan<- int {
 					// buffer full: expand it
 					last.Link(ring.New(n))
 					n *= 2
+					log.Log("sendproxy", n)
 				}
 				last = last.Next()
 			case c <- e:
 				first = first.Next()
+			case <-done:
+				ps.ring = first
+				log.Log("exit", 0)
+				return
 			}
+			sw.start()
 		}
 	}()
 	return proxy
@@ -136,98 +516,2613 @@ func sendproxy(out chan<- int) chan<- int {
 
 
 // Return a chan int of primes.
-func Sieve() chan int {
-	// The output values.
-	out := make(chan int, 1024)
-	out <- 2
-	out <- 3
-	out <- 5
-	out <- 7
-	out <- 11
+func Sieve() chan int { return sieve(Config{}.withDefaults(), nil) }
 
-	// The channel of all composites to be eliminated in increasing order.
-	composites := make(chan int, 8046)
+// Return a chan int of primes, using the options in c, or an error if
+// the options make no sense.
+func SieveWith(c Config) (<-chan int, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return sieve(c.withDefaults(), nil), nil
+}
+
+// The buffers of a sieve, which a Generator reuses for the next sieve
+// once wg shows that the goroutines of the previous one have exited.
+type pipes struct {
+	out        chan int   // the output values
+	composites chan int   // all composites to eliminate, in increasing order
+	heap       PeekChHeap // the merging heap, empty between sieves
+	ring       *ring.Ring // the buffer of sendproxy
+	wg         sync.WaitGroup
+
+	// The time spent not blocked in each phase, if Config.Timed.
+	busy [3]atomic.Int64
+}
+
+// The phases timed by Config.Timed, indexing pipes.busy.
+const (
+	mergePhase = iota
+	sievePhase
+	sendproxyPhase
+)
 
-	// The feedback loop.
-	primes := make(chan int, 1024)
-	primes <- 11
+// Return new buffers for a sieve using the options in conf.
+func newPipes(conf *Config) *pipes {
+	return &pipes{
+		out:        make(chan int, conf.Bufsize),
+		composites: make(chan int, conf.CompositeBuf),
+		heap:       make(PeekChHeap, 0, conf.CompositeBuf),
+		ring:       ring.New(1024),
+	}
+}
 
-	// Merge channels of multiples of `primes` into `composites`.
+// Merge channels of multiples of the primes received from base into the
+// returned chan of composites, in increasing order, possibly repeated.
+// The first prime received must be the smallest prime not in the wheel,
+// unless the merge resumes from the given cursors: pairs {p, m} with m
+// the next multiple of p to merge, for the primes p before those in base.
+// The goroutine exits once done is closed, leaving its heap in ps.
+func merge(base <-chan int, cursors [][2]int, conf *Config, ps *pipes, done <-chan struct{}) chan int {
+	composites := ps.composites
 	go func() {
-		h := make(PeekChHeap, 0, 8046)
-		min := 143
+		defer ps.wg.Done()
+		defer exit(conf.Logger)
+		h := ps.heap
+		defer func() {
+			clear(h)
+			ps.heap = h[:0]
+		}()
+		w := conf.wheel
+		live := 0 // the number of goroutines started by multiples
+		spawn := func() bool {
+			if conf.MaxLiveMultiples > 0 && live >= conf.MaxLiveMultiples {
+				return false
+			}
+			live++
+			return true
+		}
+		sw := newStopwatch(conf, ps, mergePhase)
+		min := w.prime * w.first
+		for _, c := range cursors {
+			p, k := c[0], c[1]/c[0]
+			next := &PeekCh{head: c[1], p: p, i: w.pos[k%len(w.pos)]}
+			if spawn() {
+				next.ch = multiplesFrom(p, k, conf, done)
+				next.head = sw.recv(next.ch, done)
+			}
+			h = append(h, next)
+		}
+		if len(h) > 0 {
+			heap.Init(&h)
+			min = h[0].head
+		}
 		for {
-			m := multiples(<-primes)
-			head := <-m
+			p := sw.recv(base, done)
+			next := &PeekCh{head: p * p, p: p, i: w.pos[p%len(w.pos)]}
+			if spawn() {
+				next.ch = multiples(p, conf, done)
+				next.head = sw.recv(next.ch, done)
+			}
+			head := next.head
 			for min < head {
-				composites <- min
+				sw.send(composites, min, done)
 				minchan := heap.Pop(&h).(*PeekCh)
 				min = minchan.head
-				minchan.head = <-minchan.ch
+				minchan.advance(w.gaps, sw, done)
 				heap.Push(&h, minchan)
 			}
 			for min == head {
 				minchan := heap.Pop(&h).(*PeekCh)
 				min = minchan.head
-				minchan.head = <-minchan.ch
+				minchan.advance(w.gaps, sw, done)
 				heap.Push(&h, minchan)
 			}
-			composites <- head
-			heap.Push(&h, &PeekCh{<-m, m})
+			sw.send(composites, head, done)
+			next.advance(w.gaps, sw, done)
+			heap.Push(&h, next)
+			conf.Logger.Log("heap", h.Len())
+		}
+	}()
+	return composites
+}
+
+// Return a chan int of primes, using the options in conf.
+// All goroutines of the sieve exit once done is closed;
+// a nil done keeps them running forever.
+func sieve(conf *Config, done <-chan struct{}) chan int {
+	ps := newPipes(conf)
+	sieveWith(conf, ps, ps.out, nil, done)
+	return ps.out
+}
+
+// Return a chan of the primes from a sieve with the default options.
+// All goroutines of the sieve exit once done is closed.
+func allPrimes(done <-chan struct{}) chan int {
+	return sieve(Config{}.withDefaults(), done)
+}
+
+// Return the chan made by mk with a new done chan, and a func closing that
+// chan, which callers that stop receiving before the end must call:
+//
+//	primes, stop := stoppable(allPrimes)
+//	defer stop()
+//
+// Nothing has to be drained: the goroutines blocked on the chan are
+// unwound by send and recv.
+func stoppable[T any](mk func(done <-chan struct{}) chan T) (chan T, func()) {
+	done := make(chan struct{})
+	return mk(done), func() { close(done) }
+}
+
+// Return the chan to which a sieve sends its output, for it to reach out.
+// This is out itself, unless watchdog.go is built in, in which case any
+// goroutine started is counted in ps.wg and exits once done is closed.
+var watch = func(out chan<- int, ps *pipes, done <-chan struct{}) chan<- int { return out }
+
+// Send the primes to out, in increasing order, until done is closed.
+// The buffering of out is up to the caller.  SieveTo returns once the
+// sieve has stopped, after which nothing more is sent to out.
+func SieveTo(out chan<- int, done <-chan struct{}) {
+	conf := Config{}.withDefaults()
+	ps := newPipes(conf)
+	sieveWith(conf, ps, out, nil, done)
+	ps.wg.Wait()
+}
+
+// Return a chan of the primes > after, from another sieve of all primes
+// using conf.
+func primesAfter(after int, conf *Config, done <-chan struct{}) chan int {
+	out := make(chan int, conf.Bufsize)
+	all := *conf
+	all.BasePrimes, all.Candidates = nil, nil
+	go func() {
+		defer exit(conf.Logger)
+		primes := sieve(&all, done)
+		for {
+			if p := recv(primes, done); p > after {
+				send(out, p, done)
+			}
 		}
 	}()
+	return out
+}
+
+// The state from which a sieve resumes: the last prime it output, and
+// the cursors of merge for all the primes p with p*p <= last.
+type resume struct {
+	last    int
+	cursors [][2]int
+}
+
+// Like sieve, but sending the output values to out, using the empty
+// buffers in ps, and resuming after from.last if from is not nil.
+func sieveWith(conf *Config, ps *pipes, out chan<- int, from *resume, done <-chan struct{}) {
+	if from == nil {
+		from = &resume{}
+	}
+	out = watch(out, ps, done)
+
+	// The feedback loop, unless the base primes come from elsewhere.
+	var feedback chan int
+	base := conf.BasePrimes
+	switch {
+	case from.last > 0:
+		// the primes between the cursors and `last` would never be fed
+		// back, so take them all from another sieve
+		after := conf.wheel.prime - 1
+		if n := len(from.cursors); n > 0 {
+			after = from.cursors[n-1][0]
+		}
+		base = primesAfter(after, conf, done)
+	case base == nil && conf.Candidates != nil:
+		// the candidates may leave out primes whose multiples are not
+		// left out, so take the base primes from another sieve
+		base = primesAfter(conf.wheel.prime-1, conf, done)
+	case base == nil:
+		feedback = make(chan int, conf.Bufsize)
+		feedback <- conf.wheel.prime
+		base = feedback
+		ps.wg.Add(1) // sendproxy
+	}
+
+	ps.wg.Add(2) // the merger and the sieve
+
+	// The channel of all composites to be eliminated in increasing order.
+	composites := merge(base, from.cursors, conf, ps, done)
 
 	// Sieve out `composites` from `candidates`.
 	go func() {
+		defer ps.wg.Done()
+		defer exit(conf.Logger)
+
 		// In order to generate the nth prime we only need multiples of
 		// primes ≤ sqrt(nth prime).  Thus, the merging goroutine will
 		// receive from this channel much slower than this goroutine
 		// will send to it, making the buffer accumulates and blocks this
 		// goroutine from sending to `primes`, causing a deadlock.  The
 		// solution is to use a proxy goroutine to do automatic buffering.
-		primes := sendproxy(primes)
+		// It is started before anything is sent, as it is counted in
+		// ps.wg even if this goroutine is stopped early.
+		var primes chan<- int
+		if feedback != nil {
+			primes = sendproxy(feedback, ps, conf, done)
+		}
+
+		if conf.Candidates == nil {
+			for _, p := range conf.wheel.basis {
+				if p > from.last {
+					send(out, p, done)
+				}
+			}
+			if conf.wheel.prime > from.last {
+				send(out, conf.wheel.prime, done)
+			}
+		}
 
-		candidates := coprime2357()
-		p := <-candidates
+		var candidates chan int
+		if conf.Candidates != nil {
+			candidates = wheelCandidates(conf.Candidates, conf, done)
+		} else if from.last > 0 {
+			w := conf.wheel
+			n := w.next(max(from.last, w.prime))
+			candidates = spin(n, 1, w.pos[n%len(w.pos)], w.gaps, conf.Bufsize, conf.Logger, done)
+		} else {
+			candidates = coprimes(conf, done)
+		}
+		sw := newStopwatch(conf, ps, sievePhase)
+		p := sw.recv(candidates, done)
 
 		for {
-			c := <-composites
+			c := sw.recv(composites, done)
 			for p < c {
-				primes <- p
-				out <- p
-				p = <-candidates
+				if primes != nil {
+					sw.send(primes, p, done)
+				}
+				sw.send(out, p, done)
+				p = sw.recv(candidates, done)
 			}
 			if p == c {
-				p = <-candidates
+				p = sw.recv(candidates, done)
 			}
 		}
 	}()
+}
+
+// A Generator yields successive primes from a sieve that can be
+// stopped, or restarted from 2 without allocating its buffers again.
+type Generator struct {
+	conf  *Config
+	pipes *pipes
+	done  chan struct{} // nil once stopped
+	last  int           // the last prime returned by Next
+}
+
+// Return a Generator of primes, using the options in c, or an error if
+// the options make no sense.  A Generator must be able to restart its
+// sieve from 2, which it cannot do with the values already received from
+// c.BasePrimes or c.Candidates, so neither may be set.
+func NewGenerator(c Config) (*Generator, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.BasePrimes != nil || c.Candidates != nil {
+		return nil, fmt.Errorf("bad config: a Generator cannot take BasePrimes or Candidates")
+	}
+	g := &Generator{conf: c.withDefaults()}
+	g.pipes = newPipes(g.conf)
+	g.start(nil)
+	return g, nil
+}
+
+func (g *Generator) start(from *resume) {
+	g.done = make(chan struct{})
+	sieveWith(g.conf, g.pipes, g.pipes.out, from, g.done)
+}
+
+// Return the next prime.  Must not be called after Stop.
+func (g *Generator) Next() int {
+	g.last = <-g.pipes.out
+	return g.last
+}
+
+// Stop the sieve and wait for its goroutines to exit.
+func (g *Generator) Stop() {
+	if g.done != nil {
+		close(g.done)
+		g.done = nil
+		g.pipes.wg.Wait()
+	}
+}
+
+// Restart the generation from 2, reusing the buffers of the sieve.
+func (g *Generator) Reset() {
+	g.Stop()
+	for len(g.pipes.out) > 0 {
+		<-g.pipes.out
+	}
+	for len(g.pipes.composites) > 0 {
+		<-g.pipes.composites
+	}
+	g.last = 0
+	g.start(nil)
+}
+
+// Return the time the merger, the sieve and sendproxy of g have spent not
+// blocked on channels since g was made, under the keys "merge", "sieve"
+// and "sendproxy".  The times are all zero unless Config.Timed was set.
+func (g *Generator) Timings() map[string]time.Duration {
+	ps := g.pipes
+	return map[string]time.Duration{
+		"merge":     time.Duration(ps.busy[mergePhase].Load()),
+		"sieve":     time.Duration(ps.busy[sievePhase].Load()),
+		"sendproxy": time.Duration(ps.busy[sendproxyPhase].Load()),
+	}
+}
+
+// Write the state of g to w, so that RestoreFrom can resume after the
+// last prime returned by Next.  The state is made of lines
+//
+//	basis 2 3 5 7
+//	last 1000003
+//
+// then "p m" for each prime p > 7 with p*p <= 1000003, where m is the next
+// multiple of p to eliminate.  It is computed and written as a stream, so
+// it need not fit in memory.
+func (g *Generator) SnapshotTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	wh := g.conf.wheel
+	fmt.Fprint(bw, "basis")
+	for _, b := range wh.basis {
+		fmt.Fprint(bw, " ", b)
+	}
+	fmt.Fprintln(bw, "\nlast", g.last)
+	done := make(chan struct{})
+	defer close(done)
+	primes := sieve(Config{WheelPrimes: wh.basis}.withDefaults(), done)
+	for p := <-primes; p <= g.last/p; p = <-primes {
+		if p >= wh.prime {
+			fmt.Fprintln(bw, p, p*wh.next(g.last/p))
+		}
+	}
+	return bw.Flush()
+}
+
+// Return a Generator resuming from the state written by SnapshotTo.
+func RestoreFrom(r io.Reader) (*Generator, error) {
+	sc := bufio.NewScanner(r)
+	line := func() string {
+		sc.Scan()
+		return sc.Text()
+	}
+	var c Config
+	basis := strings.Fields(line())
+	if len(basis) < 2 || basis[0] != "basis" {
+		return nil, fmt.Errorf("bad snapshot: no basis")
+	}
+	for _, f := range basis[1:] {
+		b, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad snapshot: basis %q", f)
+		}
+		c.WheelPrimes = append(c.WheelPrimes, b)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("bad snapshot: %v", err)
+	}
+	from := &resume{}
+	if _, err := fmt.Sscanf(line(), "last %d", &from.last); err != nil || from.last < 0 {
+		return nil, fmt.Errorf("bad snapshot: no last prime")
+	}
+	g := &Generator{conf: c.withDefaults(), last: from.last}
+	for sc.Scan() {
+		var p, m int
+		_, err := fmt.Sscan(sc.Text(), &p, &m)
+		if err != nil || p < g.conf.wheel.prime || m <= from.last || m%p != 0 ||
+			!g.conf.wheel.coprime(m/p) {
+			return nil, fmt.Errorf("bad snapshot: cursor %q", sc.Text())
+		}
+		from.cursors = append(from.cursors, [2]int{p, m})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	g.pipes = newPipes(g.conf)
+	g.start(from)
+	return g, nil
+}
+
+// Primes below this come from Auto() by sieving the odd numbers instead of
+// the 2, 3, 5, 7 wheel, whose larger start-up cost only pays off later.
+// BenchmarkAuto puts the crossover at about 500; see TIMING.
+var AutoThreshold = 500
 
+// Return a chan of the primes <= n, closed after the last one, from the
+// sieve best suited to n.
+func Auto(n int) <-chan int { return auto(n, nil) }
+
+// Like Auto(n), but closing done stops the sieve early and closes the chan.
+func auto(n int, done <-chan struct{}) chan int {
+	var c Config
+	if n < AutoThreshold {
+		c.WheelPrimes = []int{2}
+	}
+	conf := c.withDefaults()
+	out := make(chan int, 1024)
+	go func() {
+		defer close(out)
+		defer exit(conf.Logger)
+		primes, stop := stoppable(func(done <-chan struct{}) chan int {
+			return sieve(conf, done)
+		})
+		defer stop()
+		for p := <-primes; p <= n; p = <-primes {
+			send(out, p, done)
+		}
+	}()
 	return out
 }
 
-func main() {
-	flag.Parse()
-	n, err := strconv.Atoi(flag.Arg(0))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "bad argument")
-		os.Exit(1)
+// Return the sum of f(p) over all primes p <= upTo.
+// The terms are accumulated with Kahan summation to limit rounding errors.
+func primesum(upTo int, f func(p int) float64) float64 {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	sum, c := 0.0, 0.0
+	for p := <-primes; p <= upTo; p = <-primes {
+		y := f(p) - c
+		t := sum + y
+		c = (t - sum) - y
+		sum = t
 	}
-	runtime.GOMAXPROCS(*nCPU)
-	primes := Sieve()
-	if *nth {
-		for i := 1; i < n; i++ {
-			<-primes
+	return sum
+}
+
+// Return the sum of 1/p over all primes p <= upTo.
+func ReciprocalSum(upTo int) float64 {
+	return primesum(upTo, func(p int) float64 { return 1 / float64(p) })
+}
+
+// Return the partial sum of the prime zeta function P(s), for s > 1,
+// over all primes p <= upTo.
+func PrimeZeta(s float64, upTo int) float64 {
+	return primesum(upTo, func(p int) float64 { return math.Pow(float64(p), -s) })
+}
+
+// A test of primality for numbers too big to sieve.
+type PrimalityTester interface {
+	IsPrime(n *big.Int) bool
+}
+
+// Return t, or MillerRabin if t is nil.
+func testerOr(t PrimalityTester) PrimalityTester {
+	if t == nil {
+		return MillerRabin{}
+	}
+	return t
+}
+
+// Return a test of the primality of ints by t, or isPrime64 if t is nil.
+func intTester(t PrimalityTester) func(n int) bool {
+	if t == nil {
+		return isPrime64
+	}
+	return func(n int) bool { return t.IsPrime(big.NewInt(int64(n))) }
+}
+
+// The Miller-Rabin test with the first 13 primes as bases, which is
+// exact below 3.3 * 10^24 and a strong probable-prime test above.
+type MillerRabin struct{}
+
+var millerRabinBases = smallPrimes[:13]
+
+func (MillerRabin) IsPrime(n *big.Int) bool {
+	if n.Cmp(big.NewInt(smallLimit)) < 0 {
+		return IsPrime(int(n.Int64()))
+	}
+	if n.Bit(0) == 0 {
+		return false
+	}
+	one := big.NewInt(1)
+	n1 := new(big.Int).Sub(n, one)
+	r := int(n1.TrailingZeroBits())
+	d := new(big.Int).Rsh(n1, uint(r))
+	x := new(big.Int)
+	for _, a := range millerRabinBases {
+		x.Exp(big.NewInt(int64(a)), d, n)
+		if x.Cmp(one) == 0 || x.Cmp(n1) == 0 {
+			continue
 		}
-		fmt.Println(<-primes)
-	} else {
-		for {
-			p := <-primes
-			if p <= n {
-				fmt.Println(p)
-			} else {
-				return
+		i := 1
+		for ; i < r; i++ {
+			if x.Mul(x, x).Mod(x, n); x.Cmp(n1) == 0 {
+				break
+			}
+		}
+		if i == r {
+			return false
+		}
+	}
+	return true
+}
+
+// Send k-1 and k+1 to out if they are prime by t and <= max, unless done
+// is closed first.  Return false if k-1 already exceeds max.
+func sendneighbors(out chan<- int, k *big.Int, max int, t PrimalityTester, done <-chan struct{}) bool {
+	one, lim := big.NewInt(1), big.NewInt(int64(max))
+	lo := new(big.Int).Sub(k, one)
+	if lo.Cmp(lim) > 0 {
+		return false
+	}
+	for _, v := range []*big.Int{lo, new(big.Int).Add(k, one)} {
+		if v.Cmp(lim) <= 0 && t.IsPrime(v) {
+			send(out, int(v.Int64()), done)
+		}
+	}
+	return true
+}
+
+// Return a chan of the factorial primes n! - 1 and n! + 1 that are <= max,
+// tested with t, or MillerRabin if t is nil.  The chan is closed after the
+// last one.
+func FactorialPrimes(max int, t PrimalityTester) <-chan int { return factorialPrimes(max, t, nil) }
+
+// Like FactorialPrimes(max, t), but closing done closes the chan early.
+func factorialPrimes(max int, t PrimalityTester, done <-chan struct{}) chan int {
+	out := make(chan int)
+	t = testerOr(t)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		k := big.NewInt(1)
+		for n := int64(1); sendneighbors(out, k.Mul(k, big.NewInt(n)), max, t, done); n++ {
+		}
+	}()
+	return out
+}
+
+// Return a chan of the primorial primes p# - 1 and p# + 1 that are <= max,
+// where p# is the product of all primes <= p, tested with t, or MillerRabin
+// if t is nil.  The chan is closed, and the sieve stopped, after the last
+// one.
+func PrimorialPrimes(max int, t PrimalityTester) <-chan int { return primorialPrimes(max, t, nil) }
+
+// Like PrimorialPrimes(max, t), but closing done stops the sieve early and
+// closes the chan.
+func primorialPrimes(max int, t PrimalityTester, done <-chan struct{}) chan int {
+	out := make(chan int)
+	t = testerOr(t)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		primes, stop := stoppable(allPrimes)
+		defer stop()
+		k := big.NewInt(1)
+		for sendneighbors(out, k.Mul(k, big.NewInt(int64(<-primes))), max, t, done) {
+		}
+	}()
+	return out
+}
+
+// Return a chan of the repunit primes 11...1 in the given base with at
+// most maxDigits digits, in increasing order.  A repunit can only be prime
+// if its number of digits is, so only those are tested, with t, or
+// MillerRabin if t is nil.  Base 2 gives the Mersenne primes.  The chan
+// is closed after the last one.
+// RepunitPrimes(2, 20, nil) -> 3, 7, 31, 127, 8191, 131071, 524287
+// RepunitPrimes(10, 25, nil) -> 11, 1111111111111111111, 11111111111111111111111
+func RepunitPrimes(base, maxDigits int, t PrimalityTester) <-chan *big.Int {
+	return repunitPrimes(base, maxDigits, t, nil)
+}
+
+// Like RepunitPrimes(base, maxDigits, t), but closing done closes the chan
+// early.
+func repunitPrimes(base, maxDigits int, t PrimalityTester, done <-chan struct{}) chan *big.Int {
+	out := make(chan *big.Int)
+	t = testerOr(t)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		if base < 2 {
+			return
+		}
+		b := big.NewInt(int64(base))
+		r, digits := big.NewInt(0), 0
+		for _, p := range PrimesUpTo(maxDigits) {
+			for ; digits < p; digits++ {
+				r.Mul(r, b).Add(r, big.NewInt(1))
+			}
+			if t.IsPrime(r) {
+				send(out, new(big.Int).Set(r), done)
 			}
 		}
+	}()
+	return out
+}
+
+// Return a chan of the right-truncatable primes, which stay prime as their
+// last digits are removed, if right is true, else of the left-truncatable
+// primes, which have no zero digit and stay prime as their first digits
+// are removed, in increasing order.  There are finitely many of either,
+// and the chan is closed after the last one <= math.MaxInt.  Candidates
+// are tested with t, or isPrime64 if t is nil.
+// TruncatablePrimes(true, nil) -> 2, 3, 5, 7, 23, 29, 31, 37, 53, 59, ..., 73939133
+// TruncatablePrimes(false, nil) -> 2, 3, 5, 7, 13, 17, 23, 37, 43, 47, 53, ...
+func TruncatablePrimes(right bool, t PrimalityTester) <-chan int {
+	return truncatablePrimes(right, t, nil)
+}
+
+// Like TruncatablePrimes(right, t), but closing done closes the chan early.
+func truncatablePrimes(right bool, t PrimalityTester, done <-chan struct{}) chan int {
+	out := make(chan int)
+	isPrime := intTester(t)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		level := []int{2, 3, 5, 7}
+		for pow := 10; len(level) > 0; pow *= 10 {
+			var next []int
+			for _, p := range level {
+				send(out, p, done)
+			}
+			for d := 1; d <= 9; d++ {
+				for _, p := range level {
+					var n int
+					switch {
+					case right && p <= (math.MaxInt-d)/10:
+						n = p*10 + d
+					case !right && pow <= math.MaxInt/10 && d <= (math.MaxInt-p)/pow:
+						n = d*pow + p
+					default:
+						continue
+					}
+					if isPrime(n) {
+						next = append(next, n)
+					}
+				}
+			}
+			if right {
+				slices.Sort(next)
+			}
+			level = next
+		}
+	}()
+	return out
+}
+
+// All primes below smallLimit, so that small queries need no sieve.
+const smallLimit = 1000
+
+var smallPrimes = [...]int{
+	2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67,
+	71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139,
+	149, 151, 157, 163, 167, 173, 179, 181, 191, 193, 197, 199, 211, 223,
+	227, 229, 233, 239, 241, 251, 257, 263, 269, 271, 277, 281, 283, 293,
+	307, 311, 313, 317, 331, 337, 347, 349, 353, 359, 367, 373, 379, 383,
+	389, 397, 401, 409, 419, 421, 431, 433, 439, 443, 449, 457, 461, 463,
+	467, 479, 487, 491, 499, 503, 509, 521, 523, 541, 547, 557, 563, 569,
+	571, 577, 587, 593, 599, 601, 607, 613, 617, 619, 631, 641, 643, 647,
+	653, 659, 661, 673, 677, 683, 691, 701, 709, 719, 727, 733, 739, 743,
+	751, 757, 761, 769, 773, 787, 797, 809, 811, 821, 823, 827, 829, 839,
+	853, 857, 859, 863, 877, 881, 883, 887, 907, 911, 919, 929, 937, 941,
+	947, 953, 967, 971, 977, 983, 991, 997,
+}
+
+// Return the first k primes.  The sieve is stopped before returning.
+func First(k int) []int {
+	if k <= len(smallPrimes) {
+		return append([]int{}, smallPrimes[:max(k, 0)]...)
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	ps := make([]int, k)
+	for i := range ps {
+		ps[i] = <-primes
+	}
+	return ps
+}
+
+// Return every stride-th prime < upTo, starting from the one at index
+// offset, counting 2 as index 0; nil unless stride >= 1 and offset >= 0.
+// SampledPrimes(30, 3, 0) -> 2, 7, 17, 29
+// SampledPrimes(30, 4, 1) -> 3, 13, 29
+func SampledPrimes(upTo, stride, offset int) []int {
+	if stride < 1 || offset < 0 {
+		return nil
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	var ps []int
+	for i, p := 0, <-primes; p < upTo; i, p = i+1, <-primes {
+		if i >= offset && (i-offset)%stride == 0 {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// Return the nth prime, or 0 if n < 1.  The base primes come from a second
+// sieve, which only runs up to sqrt of the nth prime, so unlike the
+// feedback loop of Sieve() there is no buffer of every prime found so far
+// waiting to be merged.  The sieves are stopped before returning.
+func Nth(n int) int {
+	if n < 1 {
+		return 0
+	}
+	done := make(chan struct{})
+	defer close(done)
+	base := Config{}.withDefaults()
+	conf := *base
+	conf.BasePrimes = primesAfter(conf.wheel.prime-1, base, done)
+	primes := sieve(&conf, done)
+	for ; n > 1; n-- {
+		<-primes
+	}
+	return <-primes
+}
+
+// Return the smallest x with pi(x) == c, which is Nth(c), or 0 if c < 1.
+func PrimeAtCount(c int) int { return Nth(c) }
+
+// Return the smallest x with pi(x) >= target, or 0 if target < 1.  As pi
+// only steps up by one at each prime, this too is Nth(target).
+// SmallestXWithPi(25) -> 97
+func SmallestXWithPi(target int) int { return Nth(target) }
+
+// Return a prime < n chosen uniformly at random by r, or 0 if there is
+// none.  This takes two passes: PiFast counts the primes < n, then Nth
+// sieves up to the chosen one, so the cost is that of sieving to n.
+func RandomPrimeBelow(n int, r *rand.Rand) int {
+	k := PiFast(n - 1)
+	if k == 0 {
+		return 0
+	}
+	return Nth(r.Intn(k) + 1)
+}
+
+// Return the nth prime, for n >= 1, or ctx.Err() if ctx is done before
+// it is reached.  The sieve is stopped before returning.
+func NthContext(ctx context.Context, n int) (int, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("no prime with index %d", n)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	for {
+		select {
+		case p := <-primes:
+			if n--; n == 0 {
+				return p, nil
+			}
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Return the shortest prefix of the primes whose sum is >= s, and its
+// length.  The sieve is stopped before returning.
+// PrimesToReachSum(10) -> {2, 3, 5}, 3
+func PrimesToReachSum(s int) ([]int, int) {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	var ps []int
+	for sum := 0; sum < s; {
+		p := <-primes
+		ps = append(ps, p)
+		sum += p
+	}
+	return ps, len(ps)
+}
+
+// Return the primes <= n, including n if it is prime.  The sieve is
+// stopped before returning.
+// PrimesUpTo(7) -> 2, 3, 5, 7
+func PrimesUpTo(n int) []int {
+	if n < smallLimit {
+		return append([]int{}, smallPrimes[:sort.SearchInts(smallPrimes[:], n+1)]...)
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	var ps []int
+	for p := <-primes; p <= n; p = <-primes {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// Return the primes < n, excluding n even if it is prime.
+// PrimesBelow(7) -> 2, 3, 5
+func PrimesBelow(n int) []int { return PrimesUpTo(max(n, 1) - 1) }
+
+// The colors of PrimeColorMap, packed as 0xRRGGBBAA.
+const (
+	PrimeColor     = 0x000000ff // opaque black
+	CompositeColor = 0xffffffff // opaque white
+	UnitColor      = 0x00000000 // transparent, for 0 and 1
+)
+
+// Return the color of each integer in [0, upTo], indexed by the integer:
+// PrimeColor for the primes, CompositeColor for the composites, and
+// UnitColor for 0 and 1, which are neither.
+// PrimeColorMap(5) -> UnitColor, UnitColor, PrimeColor, PrimeColor, CompositeColor, PrimeColor
+func PrimeColorMap(upTo int) []uint32 {
+	m := make([]uint32, max(upTo+1, 0))
+	for i := range m {
+		m[i] = CompositeColor
+	}
+	for i := range min(len(m), 2) {
+		m[i] = UnitColor
+	}
+	for _, p := range PrimesUpTo(upTo) {
+		m[p] = PrimeColor
+	}
+	return m
+}
+
+// Return the largest r with r^k <= x, for x >= 0 and k >= 1.
+func iroot(x, k int) int {
+	pow := func(r int) (int, bool) { // r^k, or false on overflow past x
+		n := 1
+		for range k {
+			if n > x/r {
+				return 0, false
+			}
+			n *= r
+		}
+		return n, true
+	}
+	r := int(math.Pow(float64(x), 1/float64(k)))
+	for r > 0 {
+		if n, ok := pow(r); ok && n <= x {
+			break
+		}
+		r--
+	}
+	for {
+		if n, ok := pow(r + 1); !ok || n > x {
+			return r
+		}
+		r++
+	}
+}
+
+// State of one PiFast computation: the primes <= sqrt(x), with which
+// pi is known up to sqrt(x), and phi is memoized for small arguments.
+type lehmer struct {
+	ps   []int
+	memo map[[2]int]int
+}
+
+// Return the number of primes <= x by the Meissel-Lehmer method, which
+// needs only the primes <= sqrt(x) rather than all the primes <= x.
+// PiFast(1000000) -> 78498
+func PiFast(x int) int {
+	if x < 2 {
+		return 0
+	}
+	l := &lehmer{PrimesUpTo(max(iroot(x, 2), smallLimit)), make(map[[2]int]int)}
+	return l.pi(x)
+}
+
+// Return the number of primes <= x.
+func (l *lehmer) pi(x int) int {
+	if x <= l.ps[len(l.ps)-1] {
+		return sort.SearchInts(l.ps, x+1)
+	}
+	a := l.pi(iroot(x, 4))
+	b := l.pi(iroot(x, 2))
+	c := l.pi(iroot(x, 3))
+	sum := l.phi(x, a) + (b+a-2)*(b-a+1)/2
+	for i := a; i < b; i++ {
+		w := x / l.ps[i]
+		sum -= l.pi(w)
+		if i < c {
+			for j, bi := i, l.pi(iroot(w, 2)); j < bi; j++ {
+				sum -= l.pi(w/l.ps[j]) - j
+			}
+		}
+	}
+	return sum
+}
+
+// Return the number of n in [1, x] not divisible by the first a primes.
+func (l *lehmer) phi(x, a int) int {
+	switch {
+	case a == 0:
+		return x
+	case x < l.ps[a]:
+		return 1
+	case x <= l.ps[len(l.ps)-1] && x < l.ps[a]*l.ps[a]:
+		// the survivors besides 1 are the primes > ps[a-1]
+		return l.pi(x) - a + 1
+	}
+	small := x < 1<<16
+	if small {
+		if n, ok := l.memo[[2]int{x, a}]; ok {
+			return n
+		}
+	}
+	n := l.phi(x, a-1) - l.phi(x/l.ps[a-1], a-1)
+	if small {
+		l.memo[[2]int{x, a}] = n
+	}
+	return n
+}
+
+// Return the largest prime < n, or 0 if there is none, and the smallest
+// prime > n; n itself is never returned, even if it is prime.
+// Neighbors(100) -> 97, 101
+// Neighbors(97) -> 89, 101
+func Neighbors(n int) (prev, next int) {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	p := <-primes
+	for ; p < n; p = <-primes {
+		prev = p
+	}
+	if p == n {
+		p = <-primes
+	}
+	return prev, p
+}
+
+// Return the primes nearest to each of the count points start, start*ratio,
+// start*ratio², ..., the smaller one on a tie, for primes evenly spaced on
+// a log scale.
+// GeometricSample(10, 10, 3) -> 11, 101, 997
+func GeometricSample(start, ratio float64, count int) []int {
+	var ps []int
+	for x := start; len(ps) < count; x *= ratio {
+		m := int(max(x, 0))
+		prev, p := Neighbors(m) // the primes on either side of x
+		if IsPrime(m) {
+			prev = m
+		}
+		if prev > 0 && x-float64(prev) <= float64(p)-x {
+			p = prev
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// Report whether n is prime, by trial division with the primes <= sqrt(n).
+func IsPrime(n int) bool {
+	if n < smallLimit {
+		i := sort.SearchInts(smallPrimes[:], n)
+		return i < len(smallPrimes) && smallPrimes[i] == n
+	}
+	if n < smallLimit*smallLimit {
+		for _, p := range smallPrimes {
+			if n%p == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	for p := <-primes; p <= n/p; p = <-primes {
+		if n%p == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var maxPrime struct {
+	sync.Once
+	p int
+}
+
+// Return the largest prime <= math.MaxInt, found by testing downward.
+// The tests are exact below 2^64; the result is computed once.
+func MaxPrime() int {
+	maxPrime.Do(func() {
+		n := big.NewInt(math.MaxInt)
+		for !n.ProbablyPrime(0) {
+			n.Sub(n, big.NewInt(2))
+		}
+		maxPrime.p = int(n.Int64())
+	})
+	return maxPrime.p
+}
+
+// Return the prime factorization of n as pairs {p, e} meaning p^e,
+// in increasing order of p.  Factorize(1) is empty.
+// Factorize(360) -> {2, 3}, {3, 2}, {5, 1}
+func Factorize(n int) [][2]int {
+	var fs [][2]int
+	if n < 2 {
+		return fs
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	for p := <-primes; p <= n/p; p = <-primes {
+		e := 0
+		for ; n%p == 0; n /= p {
+			e++
+		}
+		if e > 0 {
+			fs = append(fs, [2]int{p, e})
+		}
+	}
+	if n > 1 {
+		fs = append(fs, [2]int{n, 1})
+	}
+	return fs
+}
+
+// Return the prime powers p^k <= upTo, for k >= 1, in increasing order.
+// The primes are merged with the powers p^2, p^3, ... of each prime
+// p <= sqrt(upTo) on a PeekChHeap, as merge does with multiples.
+// PrimePowers(20) -> 2, 3, 4, 5, 7, 8, 9, 11, 13, 16, 17, 19
+func PrimePowers(upTo int) []int {
+	if upTo < 2 {
+		return nil
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	h := PeekChHeap{&PeekCh{head: <-primes, ch: primes}}
+	for _, p := range PrimesUpTo(iroot(upTo, 2)) {
+		powers := make(chan int, bits.Len(uint(upTo)))
+		for q := p; q <= upTo/p; {
+			q *= p
+			powers <- q
+		}
+		close(powers)
+		h = append(h, &PeekCh{head: <-powers, ch: powers})
+	}
+	heap.Init(&h)
+	var pps []int
+	for h[0].head <= upTo {
+		minchan := heap.Pop(&h).(*PeekCh)
+		pps = append(pps, minchan.head)
+		if q, ok := <-minchan.ch; ok {
+			minchan.head = q
+			heap.Push(&h, minchan)
+		}
+	}
+	return pps
+}
+
+// Return the Fibonacci numbers F(p) at the first count primes p, stopping
+// early at F(97), the first that overflows an int.  Some, like F(3) = 2,
+// F(5) = 5, F(7) = 13 and F(11) = 89, are themselves prime.
+// PrimeFibonacci(5) -> 1, 2, 5, 13, 89
+func PrimeFibonacci(count int) []int {
+	var fs []int
+	a, b, n := 0, 1, 0 // F(n), F(n+1)
+	for _, p := range First(count) {
+		for ; n < p; n++ {
+			if b > math.MaxInt-a {
+				return fs
+			}
+			a, b = b, a+b
+		}
+		fs = append(fs, a)
+	}
+	return fs
+}
+
+// Call f(m, p) once for each prime power p^k dividing m, for k >= 1 and
+// m in [2, n], so that each prime factor of m is seen with multiplicity.
+func sweepFactors(n int, f func(m, p int)) {
+	for _, p := range PrimesUpTo(n) {
+		for q := p; q <= n; q *= p {
+			for m := q; m <= n; m += q {
+				f(m, p)
+			}
+			if q > n/p {
+				break
+			}
+		}
+	}
+}
+
+// Return s with s[m] the sum of the prime factors of m, with multiplicity,
+// for m in [2, n]; s[0] and s[1] are 0.
+// SumOfPrimeFactors(12)[2:] -> 2, 3, 4, 5, 5, 7, 6, 6, 7, 11, 7
+func SumOfPrimeFactors(n int) []int {
+	s := make([]int, max(n+1, 2))
+	sweepFactors(n, func(m, p int) { s[m] += p })
+	return s
+}
+
+// Return the numbers <= upTo that are the product of exactly k primes,
+// counted with multiplicity, in increasing order.
+// KAlmostPrimes(50, 3) -> 8, 12, 18, 20, 27, 28, 30, 42, 44, 45, 50
+func KAlmostPrimes(upTo, k int) []int {
+	omega := make([]int, max(upTo+1, 2))
+	sweepFactors(upTo, func(m, p int) { omega[m]++ })
+	var ns []int
+	for m := 2; m <= upTo; m++ {
+		if omega[m] == k {
+			ns = append(ns, m)
+		}
+	}
+	return ns
+}
+
+// Return the semiprimes <= upTo, the products of two primes.
+// SemiPrimes(25) -> 4, 6, 9, 10, 14, 15, 21, 22, 25
+func SemiPrimes(upTo int) []int { return KAlmostPrimes(upTo, 2) }
+
+// Return "perfect", "abundant" or "deficient" as the sum of the proper
+// divisors of n >= 1 is equal to, more or less than n, computing the sum
+// from the factorization of n.
+// Classify(6) -> "perfect"; Classify(12) -> "abundant"; Classify(8) -> "deficient"
+func Classify(n int) string {
+	sigma := 1 // the sum of all divisors of n
+	for _, f := range Factorize(n) {
+		s, q := 1, 1
+		for range f[1] {
+			q *= f[0]
+			s += q
+		}
+		sigma *= s
+	}
+	switch {
+	case sigma-n == n:
+		return "perfect"
+	case sigma-n > n:
+		return "abundant"
+	}
+	return "deficient"
+}
+
+// Return s with s[m] the sum of the proper divisors of m, for m in [0, n],
+// accumulated for all of them at once, in O(n log n).
+func aliquotSums(n int) []int {
+	s := make([]int, max(n+1, 0))
+	for d := 1; d <= n/2; d++ {
+		for m := 2 * d; m <= n; m += d {
+			s[m] += d
+		}
+	}
+	return s
+}
+
+// Return the perfect numbers <= n, each the sum of its proper divisors.
+// PerfectNumbersUpTo(10000) -> 6, 28, 496, 8128
+func PerfectNumbersUpTo(n int) []int {
+	s := aliquotSums(n)
+	var ps []int
+	for m := 2; m <= n; m++ {
+		if s[m] == m {
+			ps = append(ps, m)
+		}
+	}
+	return ps
+}
+
+// Return the amicable pairs {a, b} with a < b <= upTo, each the sum of
+// the proper divisors of the other, in increasing order of a.
+// AmicablePairs(3000) -> {220, 284}, {1184, 1210}, {2620, 2924}
+func AmicablePairs(upTo int) [][2]int {
+	s := aliquotSums(upTo)
+	var ps [][2]int
+	for a := 2; a <= upTo; a++ {
+		if b := s[a]; a < b && b <= upTo && s[b] == a {
+			ps = append(ps, [2]int{a, b})
+		}
+	}
+	return ps
+}
+
+// Return the first rows rows of Pascal's triangle modulo the prime p,
+// or nil if p is not prime.
+// PascalModP(3, 4) -> {1}, {1, 1}, {1, 2, 1}, {1, 0, 0, 1}
+func PascalModP(p, rows int) [][]int {
+	if !IsPrime(p) {
+		return nil
+	}
+	t := make([][]int, max(rows, 0))
+	for i := range t {
+		t[i] = make([]int, i+1)
+		t[i][0], t[i][i] = 1, 1
+		for j := 1; j < i; j++ {
+			t[i][j] = (t[i-1][j-1] + t[i-1][j]) % p
+		}
+	}
+	return t
+}
+
+// A growing list of the primes found by one long-running sieve,
+// shared by concurrent callers so that the sieving is done only once.
+type cache struct {
+	sync.Mutex
+	primes chan int      // started on first use
+	done   chan struct{} // closed to stop primes
+	ps     []int
+}
+
+var shared cache
+
+// Make sure the cache holds at least k primes and the first prime > n.
+// Must be called with c locked.
+func (c *cache) extend(k, n int) {
+	if c.primes == nil {
+		c.done = make(chan struct{})
+		c.primes = sieve(Config{}.withDefaults(), c.done)
+	}
+	for len(c.ps) < k || len(c.ps) == 0 || c.ps[len(c.ps)-1] <= n {
+		c.ps = append(c.ps, <-c.primes)
+	}
+}
+
+// Stop the sieve of c, if it was started, and empty c.
+func (c *cache) close() {
+	c.Lock()
+	defer c.Unlock()
+	if c.primes != nil {
+		close(c.done)
+		c.primes, c.ps = nil, nil
+	}
+}
+
+// Return the nth prime, for n >= 1.
+func (c *cache) nth(n int) int {
+	c.Lock()
+	defer c.Unlock()
+	c.extend(n, 0)
+	return c.ps[n-1]
+}
+
+// Return the primes <= n.  The result must not be modified.
+func (c *cache) upTo(n int) []int {
+	c.Lock()
+	defer c.Unlock()
+	c.extend(0, n)
+	return c.ps[:sort.SearchInts(c.ps, n+1)]
+}
+
+// Report whether n is prime, by trial division with the cached primes.
+func (c *cache) isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for _, p := range c.upTo(int(math.Sqrt(float64(n))) + 1) {
+		if p > n/p {
+			break
+		}
+		if n%p == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// A sorted table of the primes, extended by its own sieve as queries need,
+// for repeated lookups in any order.  The zero value is ready to use, and
+// a Table is safe for concurrent use.  Its sieve runs until Close.
+type Table struct {
+	c cache
+}
+
+// Stop the sieve of t and empty t.  Close must be called once t is no
+// longer needed, or the goroutines of its sieve are never freed.  A
+// closed Table may be used again, with a new sieve, and closed again.
+func (t *Table) Close() { t.c.close() }
+
+// Report whether x is prime, by binary search in the table.
+func (t *Table) Contains(x int) bool {
+	ps := t.c.upTo(x)
+	return len(ps) > 0 && ps[len(ps)-1] == x
+}
+
+// Return the primes < x.
+func (t *Table) Below(x int) []int {
+	return slices.Clone(t.c.upTo(x - 1))
+}
+
+// Return the index of p among the primes, starting from 1, and true, or
+// false if p is not prime or not yet in the table, which is not extended.
+// The primes are close enough to evenly spaced for an interpolation
+// search, which takes fewer probes than a binary search.
+// IndexOf(2) -> 1, true; IndexOf(7919) -> 1000, true; IndexOf(9) -> 0, false
+func (t *Table) IndexOf(p int) (int, bool) {
+	t.c.Lock()
+	defer t.c.Unlock()
+	ps := t.c.ps
+	lo, hi := 0, len(ps)-1
+	for lo <= hi && ps[lo] <= p && p <= ps[hi] {
+		i := lo
+		if ps[hi] > ps[lo] {
+			i += (p - ps[lo]) * (hi - lo) / (ps[hi] - ps[lo])
+		}
+		switch {
+		case ps[i] < p:
+			lo = i + 1
+		case ps[i] > p:
+			hi = i - 1
+		default:
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// A Bloom filter of the primes <= n, which never has false negatives.
+type Bloom struct {
+	n    int
+	k    int      // the number of hashes per value
+	bits []uint64 // the filter, of len(bits) * 64 bits
+}
+
+// Return a Bloom filter of the primes <= n with a false positive rate of
+// about fpRate, which is clamped to [1e-9, 0.5], as a higher rate would
+// take no fewer bits and a rate of 0 would take infinitely many.  It is
+// sized with PiFast(n), and the primes are streamed into it rather than
+// held.
+func BloomUpTo(n int, fpRate float64) *Bloom {
+	if !(fpRate >= 1e-9) { // also NaN
+		fpRate = 1e-9
+	}
+	fpRate = min(fpRate, 0.5)
+	count := float64(max(PiFast(n), 1))
+	m := -count * math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	b := &Bloom{
+		n:    n,
+		k:    max(int(math.Round(m/count*math.Ln2)), 1),
+		bits: make([]uint64, int(m)/64+1),
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	for p := <-primes; p <= n; p = <-primes {
+		b.each(p, func(i uint64) { b.bits[i/64] |= 1 << (i % 64) })
+	}
+	return b
+}
+
+// Call f with the k bit indexes of x, from two hashes of x.
+func (b *Bloom) each(x int, f func(i uint64)) {
+	h := uint64(x) * 0x9e3779b97f4a7c15
+	h1, h2 := h^h>>29, (h^h>>32)*0xbf58476d1ce4e5b9|1
+	size := uint64(len(b.bits)) * 64
+	for j := range uint64(b.k) {
+		f((h1 + j*h2) % size)
+	}
+}
+
+// Report whether x may be prime: always true if x is a prime <= n, and
+// also true for some composites, and for every x > n.
+func (b *Bloom) MaybePrime(x int) bool {
+	if x < 2 {
+		return false
+	}
+	if x > b.n {
+		return true
+	}
+	maybe := true
+	b.each(x, func(i uint64) { maybe = maybe && b.bits[i/64]&(1<<(i%64)) != 0 })
+	return maybe
+}
+
+// Report whether every even number in [4, upTo] is the sum of two primes,
+// and if not, return the first that is not.  The primes come from the
+// shared cache.
+func VerifyGoldbach(upTo int) (firstFailure int, ok bool) {
+	ps := shared.upTo(upTo)
+	prime := make([]bool, max(upTo+1, 0))
+	for _, p := range ps {
+		prime[p] = true
+	}
+	for n := 4; n <= upTo; n += 2 {
+		i := 0
+		for i < len(ps) && ps[i] <= n/2 && !prime[n-ps[i]] {
+			i++
+		}
+		if i == len(ps) || ps[i] > n/2 {
+			return n, false
+		}
+	}
+	return 0, true
+}
+
+// Report whether n is prime, by trial division with the shared cache
+// where that is cheap, else by MillerRabin.
+func isPrime64(n int) bool {
+	if n < 1<<40 {
+		return shared.isPrime(n)
+	}
+	return MillerRabin{}.IsPrime(big.NewInt(int64(n)))
+}
+
+// Return the count terms a, a+d, a+2d, ... and true if they are all
+// prime, else the prime terms before the first composite and false.
+// Primality is tested with isPrime64, so that large terms do not grow the
+// shared cache.
+// APPrimes(5, 6, 5) -> {5, 11, 17, 23, 29}, true
+func APPrimes(a, d, count int) ([]int, bool) {
+	var ps []int
+	for n := a; len(ps) < count; n += d {
+		if !isPrime64(n) {
+			return ps, false
+		}
+		ps = append(ps, n)
+	}
+	return ps, true
+}
+
+// Return the smallest prime > n/2 that does not divide n, or 0 if n < 1.
+// It is coprime to n, so i = (i + stride) % n visits every index in [0, n)
+// exactly once in n steps.
+// PrimeStride(10) -> 7
+func PrimeStride(n int) int {
+	if n < 1 {
+		return 0
+	}
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	p := <-primes
+	for p <= n/2 || n%p == 0 {
+		p = <-primes
+	}
+	return p
+}
+
+// Report whether the offsets in pattern are admissible, that is, for no
+// prime p do they cover all residues modulo p.  Only an admissible
+// pattern, like {0, 2, 6}, can occur infinitely often as n + pattern[i]
+// all prime; {0, 2, 4} cannot, as one of n, n+2, n+4 is divisible by 3.
+func IsAdmissible(pattern []int) bool {
+	for _, p := range PrimesUpTo(len(pattern)) {
+		seen := make(map[int]bool)
+		for _, d := range pattern {
+			seen[(d%p+p)%p] = true
+		}
+		if len(seen) == p {
+			return false
+		}
+	}
+	return true
+}
+
+// Return a chan of pairs {p, g}, where g is the gap between the prime p
+// and the next prime.
+// Gaps() -> {2, 1}, {3, 2}, {5, 2}, {7, 4}, {11, 2}, {13, 4}, ...
+func Gaps() chan [2]int { return gaps(nil) }
+
+// Like Gaps(), but all goroutines exit once done is closed.
+func gaps(done <-chan struct{}) chan [2]int {
+	out := make(chan [2]int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := sieve(Config{}.withDefaults(), done)
+		p := recv(primes, done)
+		for {
+			q := recv(primes, done)
+			send(out, [2]int{p, q - p}, done)
+			p = q
+		}
+	}()
+	return out
+}
+
+// Return the pairs {p, g} from Gaps() with g >= minGap and p + g <= upTo.
+// GapsAtLeast(8, 200) -> {89, 8}, {113, 14}, {139, 10}, {181, 10}
+func GapsAtLeast(minGap, upTo int) [][2]int {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	var gs [][2]int
+	for g := <-ch; g[0]+g[1] <= upTo; g = <-ch {
+		if g[1] >= minGap {
+			gs = append(gs, g)
+		}
+	}
+	return gs
+}
+
+// Return the first prime p followed by a gap of exactly g to the next
+// prime, and true, or false if there can be none: for g < 1 or odd g > 1.
+// Every even gap is believed to occur, but for large g the search may run
+// far, the first gap of 100 following 396733.
+// FirstGapOfSize(2) -> 3, true; FirstGapOfSize(6) -> 23, true
+func FirstGapOfSize(g int) (prime int, found bool) {
+	if g < 1 || g > 1 && g%2 == 1 {
+		return 0, false
+	}
+	ch, stop := stoppable(gaps)
+	defer stop()
+	for {
+		if pg := <-ch; pg[1] == g {
+			return pg[0], true
+		}
+	}
+}
+
+// Return the pairs {p, g} from Gaps() with p + g <= upTo whose gap exceeds
+// the average gap near p, about ln(p), by more than sigma times ln(p).
+// AnomalousGaps(200, 1) -> {7, 4}, {113, 14}, {139, 10}
+func AnomalousGaps(upTo int, sigma float64) [][2]int {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	var gs [][2]int
+	for g := <-ch; g[0]+g[1] <= upTo; g = <-ch {
+		avg := math.Log(float64(g[0]))
+		if float64(g[1])-avg > sigma*avg {
+			gs = append(gs, g)
+		}
+	}
+	return gs
+}
+
+// Return the difference table of the first count primes: row 0 holds the
+// primes, row 1 their gaps from Gaps(), and each row k up to order the
+// differences of consecutive entries in row k-1.
+// PrimeDifferences(2, 5) -> {2, 3, 5, 7, 11}, {1, 2, 2, 4}, {1, 0, 2}
+func PrimeDifferences(order, count int) [][]int {
+	count = max(count, 0)
+	ch, stop := stoppable(gaps)
+	defer stop()
+	primes, diffs := make([]int, count), make([]int, count)
+	for i := range count {
+		g := <-ch
+		primes[i], diffs[i] = g[0], g[1]
+	}
+	rows := [][]int{primes}
+	if order >= 1 {
+		rows = append(rows, diffs[:max(count-1, 0)])
+	}
+	for k := 2; k <= order; k++ {
+		prev := rows[k-1]
+		row := make([]int, max(len(prev)-1, 0))
+		for i := range row {
+			row[i] = prev[i+1] - prev[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Return how often each gap occurs between consecutive primes among the
+// first windowPrimes primes.
+// PairDiffs(10) -> {1: 1, 2: 4, 4: 3, 6: 1}
+func PairDiffs(windowPrimes int) map[int]int {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	freq := make(map[int]int)
+	for range windowPrimes - 1 {
+		freq[(<-ch)[1]]++
+	}
+	return freq
+}
+
+// Return the sample autocorrelation at the given lag of the gaps between
+// the first count primes, or NaN if there are too few gaps.
+// GapAutocorrelation(1, 6) -> -0.0917, from the gaps 1, 2, 2, 4, 2
+func GapAutocorrelation(lag, count int) float64 {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	g := make([]float64, max(count-1, 0))
+	mean := 0.0
+	for i := range g {
+		g[i] = float64((<-ch)[1])
+		mean += g[i] / float64(len(g))
+	}
+	if lag < 0 || lag >= len(g) {
+		return math.NaN()
+	}
+	var num, den float64
+	for i := range g {
+		den += (g[i] - mean) * (g[i] - mean)
+		if i+lag < len(g) {
+			num += (g[i] - mean) * (g[i+lag] - mean)
+		}
+	}
+	return num / den
+}
+
+// Return the most frequent gap between consecutive primes <= upTo, the
+// smallest one in case of a tie, or 0 if there is no gap.
+// JumpingChampion(100) -> 2
+// JumpingChampion(1000) -> 6
+func JumpingChampion(upTo int) int {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	freq := make(map[int]int)
+	champ := 0
+	for g := <-ch; g[0]+g[1] <= upTo; g = <-ch {
+		freq[g[1]]++
+		if n, m := freq[g[1]], freq[champ]; n > m || n == m && g[1] < champ {
+			champ = g[1]
+		}
+	}
+	return champ
+}
+
+// An entry of GapMerits.
+type gapMerit = struct {
+	Prime int
+	Merit float64
+}
+
+// Return the primes p, with p + g <= upTo, at which the merit g/ln(p) of
+// the gap g to the next prime sets a new record, with that merit.
+// GapMerits(200) -> {2, 1.44}, {3, 1.82}, {7, 2.06}, {113, 2.96}
+func GapMerits(upTo int) []gapMerit {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	var ms []gapMerit
+	best := 0.0
+	for g := <-ch; g[0]+g[1] <= upTo; g = <-ch {
+		if m := float64(g[1]) / math.Log(float64(g[0])); m > best {
+			best = m
+			ms = append(ms, gapMerit{g[0], m})
+		}
+	}
+	return ms
+}
+
+// Return the prime p < n at which the merit g/ln(p) of the gap g to the
+// next prime is highest, the first one on a tie, with that merit; or 0, 0
+// if n <= 2.  Unlike the largest gap, this favors gaps large for their p.
+// MaxMeritBelow(100) -> 7, 2.06; MaxMeritBelow(1000) -> 113, 2.96
+func MaxMeritBelow(n int) (prime int, merit float64) {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	for g := <-ch; g[0] < n; g = <-ch {
+		if m := float64(g[1]) / math.Log(float64(g[0])); m > merit {
+			prime, merit = g[0], m
+		}
+	}
+	return prime, merit
+}
+
+// An entry of GapCDF.
+type gapFrac = struct {
+	Gap  int
+	Frac float64
+}
+
+// Return, for each gap size between consecutive primes <= upTo, the
+// fraction of those gaps that are no larger, in increasing order of gap.
+// GapCDF(50) -> {1, 1/14}, {2, 7/14}, {4, 12/14}, {6, 1}
+func GapCDF(upTo int) []gapFrac {
+	ch, stop := stoppable(gaps)
+	defer stop()
+	freq := make(map[int]int)
+	total := 0
+	for g := <-ch; g[0]+g[1] <= upTo; g = <-ch {
+		freq[g[1]]++
+		total++
+	}
+	cdf := make([]gapFrac, 0, len(freq))
+	for g := range freq {
+		cdf = append(cdf, gapFrac{Gap: g})
+	}
+	sort.Slice(cdf, func(i, j int) bool { return cdf[i].Gap < cdf[j].Gap })
+	sum := 0
+	for i := range cdf {
+		sum += freq[cdf[i].Gap]
+		cdf[i].Frac = float64(sum) / float64(total)
+	}
+	return cdf
+}
+
+// An entry of GapVsExpected.
+type gapExpected = struct {
+	Prime, Gap int
+	Expected   float64
+}
+
+// Return a chan of the entries of Gaps(), each with ln(p), the average gap
+// near p by the prime number theorem.
+// GapVsExpected() -> {2, 1, 0.69}, {3, 2, 1.10}, {5, 2, 1.61}, {7, 4, 1.95}, ...
+func GapVsExpected() <-chan gapExpected { return gapVsExpected(nil) }
+
+// Like GapVsExpected(), but all goroutines exit once done is closed.
+func gapVsExpected(done <-chan struct{}) chan gapExpected {
+	out := make(chan gapExpected, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		gaps := gaps(done)
+		for {
+			g := recv(gaps, done)
+			send(out, gapExpected{g[0], g[1], math.Log(float64(g[0]))}, done)
+		}
+	}()
+	return out
+}
+
+// Return a chan of the prime quadruplets {p, p+2, p+6, p+8}.
+// Quadruplets() -> {5, 7, 11, 13}, {11, 13, 17, 19}, {101, 103, 107, 109}, ...
+func Quadruplets() chan [4]int { return quadruplets(nil) }
+
+// Like Quadruplets(), but all goroutines exit once done is closed.
+func quadruplets(done <-chan struct{}) chan [4]int {
+	out := make(chan [4]int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := sieve(Config{}.withDefaults(), done)
+		var q [4]int // a window of consecutive primes
+		for i := range 3 {
+			q[i+1] = recv(primes, done)
+		}
+		for {
+			copy(q[:], q[1:])
+			q[3] = recv(primes, done)
+			if q[1] == q[0]+2 && q[2] == q[0]+6 && q[3] == q[0]+8 {
+				send(out, q, done)
+			}
+		}
+	}()
+	return out
+}
+
+// Return the prime quadruplets from Quadruplets() with p+8 <= n.
+func QuadrupletsUpTo(n int) [][4]int {
+	ch, stop := stoppable(quadruplets)
+	defer stop()
+	var qs [][4]int
+	for q := <-ch; q[3] <= n; q = <-ch {
+		qs = append(qs, q)
+	}
+	return qs
+}
+
+// An entry of Annotate.
+type indexedPrime = struct{ Index, Prime int }
+
+// Return a chan of the primes, each with its index, starting from 1.
+// Annotate() -> {1, 2}, {2, 3}, {3, 5}, {4, 7}, {5, 11}, ...
+func Annotate() <-chan indexedPrime { return annotate(nil) }
+
+// Like Annotate(), but all goroutines exit once done is closed.
+func annotate(done <-chan struct{}) chan indexedPrime {
+	out := make(chan indexedPrime, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := allPrimes(done)
+		for i := 1; ; i++ {
+			send(out, indexedPrime{i, recv(primes, done)}, done)
+		}
+	}()
+	return out
+}
+
+// Return an iterator over the pairs (i, the ith prime), for i >= 1.
+// The sieve is stopped when the loop over it ends.
+// Enumerated() -> (1, 2), (2, 3), (3, 5), (4, 7), (5, 11), ...
+func Enumerated() iter.Seq2[int, int] {
+	return func(yield func(int, int) bool) {
+		primes, stop := stoppable(annotate)
+		defer stop()
+		for e := <-primes; yield(e.Index, e.Prime); e = <-primes {
+		}
+	}
+}
+
+// Return a chan of the primes at odd positions (the 1st, 3rd, 5th, ...)
+// if odd is true, else those at even positions (the 2nd, 4th, 6th, ...).
+// ByIndexParity(true) -> 2, 5, 11, 17, 23, 31, 41, 47, 59, 67, ...
+// ByIndexParity(false) -> 3, 7, 13, 19, 29, 37, 43, 53, 61, 71, ...
+func ByIndexParity(odd bool) <-chan int { return byIndexParity(odd, nil) }
+
+// Like ByIndexParity(odd), but all goroutines exit once done is closed.
+func byIndexParity(odd bool, done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := allPrimes(done)
+		if !odd {
+			recv(primes, done)
+		}
+		for {
+			send(out, recv(primes, done), done)
+			recv(primes, done)
+		}
+	}()
+	return out
+}
+
+// Return a chan of the primes p ≡ 3 (mod 4), which stay prime in the
+// Gaussian integers.
+// GaussianInertPrimes() -> 3, 7, 11, 19, 23, 31, 43, 47, 59, 67, ...
+func GaussianInertPrimes() <-chan int { return gaussianPrimes(false, nil) }
+
+// Return a chan of 2, which ramifies in the Gaussian integers as -i(1+i)²,
+// followed by the primes p ≡ 1 (mod 4), which split into two conjugates.
+// GaussianSplitPrimes() -> 2, 5, 13, 17, 29, 37, 41, 53, 61, 73, ...
+func GaussianSplitPrimes() <-chan int { return gaussianPrimes(true, nil) }
+
+// Return a chan of 2 and the primes ≡ 1 (mod 4) if split, else of the
+// primes ≡ 3 (mod 4).  All goroutines exit once done is closed.
+func gaussianPrimes(split bool, done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := allPrimes(done)
+		recv(primes, done) // 2, which is neither
+		if split {
+			send(out, 2, done)
+		}
+		for {
+			if p := recv(primes, done); (p%4 == 1) == split {
+				send(out, p, done)
+			}
+		}
+	}()
+	return out
+}
+
+// Return a chan of pairs {p, the number of one bits in p} for the primes p.
+// PopcountPrimes() -> {2, 1}, {3, 2}, {5, 2}, {7, 3}, {11, 3}, {13, 3}, ...
+func PopcountPrimes() <-chan [2]int { return popcountPrimes(nil) }
+
+// Like PopcountPrimes(), but all goroutines exit once done is closed.
+func popcountPrimes(done <-chan struct{}) chan [2]int {
+	out := make(chan [2]int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := allPrimes(done)
+		for {
+			p := recv(primes, done)
+			send(out, [2]int{p, bits.OnesCount(uint(p))}, done)
+		}
+	}()
+	return out
+}
+
+// Return a chan of the primes with exactly k one bits.  Only 2 has one,
+// and those with two are the Fermat primes, of which no more than five
+// are known, so the chan may never yield another value.
+// PopcountPrimesFilter(2) -> 3, 5, 17, 257, 65537
+// PopcountPrimesFilter(3) -> 7, 11, 13, 19, 37, 41, 67, 73, 97, 131, ...
+func PopcountPrimesFilter(k int) <-chan int { return popcountPrimesFilter(k, nil) }
+
+// Like PopcountPrimesFilter(), but all goroutines exit once done is closed.
+func popcountPrimesFilter(k int, done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := sieve(Config{}.withDefaults(), done)
+		for {
+			if p := recv(primes, done); bits.OnesCount(uint(p)) == k {
+				send(out, p, done)
+			}
+		}
+	}()
+	return out
+}
+
+// An entry of LocalDensity.
+type windowCount = struct{ Center, Count int }
+
+// Return a chan of the number of primes in each window [k*w, (k+1)*w) for
+// k = 0, 1, 2, ..., with its center k*w + w/2, sent as soon as the sieve
+// has passed the window.  The width w must be positive.
+// LocalDensity(10) -> {5, 4}, {15, 4}, {25, 2}, {35, 2}, {45, 3}, {55, 2}, ...
+func LocalDensity(w int) <-chan windowCount { return localDensity(w, nil) }
+
+// Like LocalDensity(w), but all goroutines exit once done is closed.
+func localDensity(w int, done <-chan struct{}) chan windowCount {
+	out := make(chan windowCount, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := allPrimes(done)
+		p := recv(primes, done)
+		for lo := 0; ; lo += w {
+			n := 0
+			for ; p < lo+w; p = recv(primes, done) {
+				n++
+			}
+			send(out, windowCount{lo + w/2, n}, done)
+		}
+	}()
+	return out
+}
+
+// A Reader of the low bytes of the primes.
+type byteReader struct {
+	primes chan int
+}
+
+// Return a Reader of the low byte of each successive prime, which never
+// ends.  This is a deterministic test pattern, not a source of randomness:
+// it is entirely predictable, and no byte is ever even but the first.
+// ByteStream() -> 2, 3, 5, 7, 11, 13, 17, 19, 23, 29, ..., 251, 1, 7, ...
+func ByteStream() io.Reader { return byteStream(nil) }
+
+// Like ByteStream(), but the sieve is stopped once done is closed, after
+// which the Reader must not be read.
+func byteStream(done <-chan struct{}) io.Reader {
+	return &byteReader{allPrimes(done)}
+}
+
+func (b *byteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(<-b.primes)
+	}
+	return len(p), nil
+}
+
+// Return the sum of the decimal digits of n >= 0.
+func digitSum(n int) int {
+	s := 0
+	for ; n > 0; n /= 10 {
+		s += n % 10
+	}
+	return s
+}
+
+// Return a chan of the primes whose decimal digits sum to targetSum.
+// The chan may never yield another value: only 3 qualifies if 3 divides
+// targetSum, and with targetSum 2 none is known after 101.
+// DigitSumPrimes(2) -> 2, 11, 101
+// DigitSumPrimes(4) -> 13, 31, 103, 211, 1021, 1201, 2011, 3001, ...
+func DigitSumPrimes(targetSum int) <-chan int { return digitSumPrimes(targetSum, nil) }
+
+// Like DigitSumPrimes(), but all goroutines exit once done is closed.
+func digitSumPrimes(targetSum int, done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := sieve(Config{}.withDefaults(), done)
+		for {
+			if p := recv(primes, done); digitSum(p) == targetSum {
+				send(out, p, done)
+			}
+		}
+	}()
+	return out
+}
+
+// Return the primes <= n whose decimal digits sum to targetSum.
+func DigitSumPrimesUpTo(targetSum, n int) []int {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	var ps []int
+	for p := <-primes; p <= n; p = <-primes {
+		if digitSum(p) == targetSum {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// Report whether the decimal digits of n >= 0 read the same both ways.
+func palindrome(n int) bool {
+	r := 0
+	for m := n; m > 0; m /= 10 {
+		r = r*10 + m%10
+	}
+	return r == n
+}
+
+// Return the palindromic prime closest to n, the smaller one on a tie.
+// Numbers are tried outward from n, in both directions, and only the
+// palindromes among them are tested with IsPrime.
+// NearestPalindromicPrime(100) -> 101
+// NearestPalindromicPrime(131) -> 131
+func NearestPalindromicPrime(n int) int {
+	for d := 0; ; d++ {
+		if m := n - d; m >= 2 && palindrome(m) && IsPrime(m) {
+			return m
+		}
+		if m := n + d; m >= 2 && palindrome(m) && IsPrime(m) {
+			return m
+		}
+	}
+}
+
+// Return a chan of the primes all of whose decimal digit rotations are
+// prime, tested with t, or isPrime64 if t is nil.
+// CircularPrimes(nil) -> 2, 3, 5, 7, 11, 13, 17, 31, 37, 71, 73, 79, 97, 113, ...
+func CircularPrimes(t PrimalityTester) <-chan int { return circularPrimes(t, nil) }
+
+// Like CircularPrimes(), but all goroutines exit once done is closed.
+func circularPrimes(t PrimalityTester, done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	isPrime := intTester(t)
+	go func() {
+		defer exit(nopLogger{})
+		primes := sieve(Config{}.withDefaults(), done)
+		for {
+			p := recv(primes, done)
+			digits := len(strconv.Itoa(p))
+			pow := int(math.Pow10(digits - 1))
+			r, circular := p, true
+			for range digits - 1 {
+				if r = r%pow*10 + r/pow; !isPrime(r) {
+					circular = false
+					break
+				}
+			}
+			if circular {
+				send(out, p, done)
+			}
+		}
+	}()
+	return out
+}
+
+// Return a chan of the squares of primes, closed before p*p would
+// overflow.
+// Squares() -> 4, 9, 25, 49, 121, 169, 289, 361, 529, 841, ...
+func Squares() <-chan int { return squares(nil) }
+
+// Like Squares(), but closing done stops the sieve early and closes the
+// chan.
+func squares(done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		primes, stop := stoppable(allPrimes)
+		defer stop()
+		for p := <-primes; p <= math.MaxInt/p; p = <-primes {
+			send(out, p*p, done)
+		}
+	}()
+	return out
+}
+
+// Return a chan of the pairs of values received from a and b in step,
+// closed when either of them is closed.  Zipping the odds sieve with the
+// wheel sieve shows that they agree.
+// Zip(Sieve(), Squares()) -> {2, 4}, {3, 9}, {5, 25}, {7, 49}, ...
+func Zip(a, b <-chan int) <-chan [2]int { return zip(a, b, nil) }
+
+// Like Zip(a, b), but closing done closes the chan early.
+func zip(a, b <-chan int, done <-chan struct{}) chan [2]int {
+	out := make(chan [2]int, 1024)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		for {
+			x, ok := recvOK(a, done)
+			if !ok {
+				return
+			}
+			y, ok := recvOK(b, done)
+			if !ok {
+				return
+			}
+			send(out, [2]int{x, y}, done)
+		}
+	}()
+	return out
+}
+
+// Return a chan of the primes <= n followed by sentinel, then closed, for
+// consumers that look for an end value.  The sentinel should be a value
+// that cannot be mistaken for one of the primes, such as 0 or -1.
+// UpToSentinel(10, -1) -> 2, 3, 5, 7, -1
+func UpToSentinel(n, sentinel int) <-chan int { return upToSentinel(n, sentinel, nil) }
+
+// Like UpToSentinel(n, sentinel), but closing done stops the sieve early,
+// and closes the chan without the sentinel.
+func upToSentinel(n, sentinel int, done <-chan struct{}) chan int {
+	out := make(chan int, 1024)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		primes, stop := stoppable(allPrimes)
+		defer stop()
+		for p := <-primes; p <= n; p = <-primes {
+			send(out, p, done)
+		}
+		send(out, sentinel, done)
+	}()
+	return out
+}
+
+// Return a chan of slices of size consecutive primes, which must be
+// positive, for consumers to whom one channel operation per prime costs
+// too much.  Each slice is new, so the receiver may keep it.
+// Batched(4) -> [2 3 5 7], [11 13 17 19], [23 29 31 37], ...
+func Batched(size int) <-chan []int { return batched(size, math.MaxInt, nil) }
+
+// Return a chan of slices of size consecutive primes <= n, which must be
+// positive, the last of which may be shorter, then closed.
+// BatchedUpTo(4, 30) -> [2 3 5 7], [11 13 17 19], [23 29]
+func BatchedUpTo(size, n int) <-chan []int { return batched(size, n, nil) }
+
+// Like BatchedUpTo(size, n), but closing done stops the sieve early and
+// closes the chan.
+func batched(size, n int, done <-chan struct{}) chan []int {
+	out := make(chan []int, 16)
+	go func() {
+		defer close(out)
+		defer exit(nopLogger{})
+		primes, stop := stoppable(allPrimes)
+		defer stop()
+		b := make([]int, 0, size)
+		for p := <-primes; p <= n; p = <-primes {
+			if b = append(b, p); len(b) == size {
+				send(out, b, done)
+				b = make([]int, 0, size)
+			}
+		}
+		if len(b) > 0 {
+			send(out, b, done)
+		}
+	}()
+	return out
+}
+
+// Return a chan of the running products of primes modulo mod.
+// It panics if mod < 1.
+// RollingProductMod(1000) -> 2, 6, 30, 210, 310, 30, 510, 690, 870, 230, ...
+func RollingProductMod(mod int) <-chan int { return rollingProductMod(mod, nil) }
+
+// Like RollingProductMod(mod), but all goroutines exit once done is closed.
+func rollingProductMod(mod int, done <-chan struct{}) chan int {
+	if mod < 1 {
+		panic("RollingProductMod: mod < 1")
+	}
+	out := make(chan int, 1024)
+	go func() {
+		defer exit(nopLogger{})
+		primes := allPrimes(done)
+		m := uint64(mod)
+		prod := 1 % m
+		for {
+			hi, lo := bits.Mul64(prod, uint64(recv(primes, done)))
+			prod = bits.Rem64(hi, lo, m)
+			send(out, int(prod), done)
+		}
+	}()
+	return out
+}
+
+// Return the 64-bit FNV-1a hash of the primes <= upTo written one per line
+// in decimal, which is also the hash of the output of sieve1.go, sieve2.go
+// or sieve3.go given upTo, so that runs and versions can be compared.
+func Checksum(upTo int) uint64 {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	h := fnv.New64a()
+	var buf []byte
+	for p := <-primes; p <= upTo; p = <-primes {
+		buf = strconv.AppendInt(buf[:0], int64(p), 10)
+		h.Write(append(buf, '\n'))
+	}
+	return h.Sum64()
+}
+
+// Write the primes <= upTo to w as big-endian uint64s, in increasing
+// order, so that LookupInSortedSet can binary-search them.
+func WriteSortedSet(w io.Writer, upTo int) error {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	bw := bufio.NewWriter(w)
+	var buf [8]byte
+	for p := <-primes; p <= upTo; p = <-primes {
+		binary.BigEndian.PutUint64(buf[:], uint64(p))
+		if _, err := bw.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Report whether x is in the set written by WriteSortedSet to r, which
+// holds size bytes.  A read error counts as not found.
+func LookupInSortedSet(r io.ReaderAt, size int, x uint64) bool {
+	var buf [8]byte
+	at := func(i int) (uint64, error) {
+		_, err := r.ReadAt(buf[:], int64(i)*8)
+		return binary.BigEndian.Uint64(buf[:]), err
+	}
+	n := size / 8
+	i := sort.Search(n, func(i int) bool {
+		v, err := at(i)
+		return err != nil || v >= x
+	})
+	if i == n {
+		return false
+	}
+	v, err := at(i)
+	return err == nil && v == x
+}
+
+// Print the frequency of each gap between consecutive primes in [lo, hi],
+// sorted by gap size.
+func printgaps(w io.Writer, lo, hi int) {
+	freq := make(map[int]int)
+	ch, stop := stoppable(gaps)
+	defer stop()
+	for g := <-ch; g[0]+g[1] <= hi; g = <-ch {
+		if g[0] >= lo {
+			freq[g[1]]++
+		}
+	}
+	sizes := make([]int, 0, len(freq))
+	for g := range freq {
+		sizes = append(sizes, g)
+	}
+	sort.Ints(sizes)
+	for _, g := range sizes {
+		fmt.Fprintln(w, g, freq[g])
+	}
+}
+
+// The largest n accepted by /nth and /upto, which extend the shared cache
+// up to the answer and keep it.
+const serveLimit = 1000000
+
+// Return a handler of HTTP requests like /nth?n=1000, /upto?n=100 and
+// /isprime?n=97, with JSON responses computed from the shared cache.
+func handler() http.Handler {
+	mux := http.NewServeMux()
+	handle := func(path string, limit int, f func(n int) interface{}) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			n, err := strconv.Atoi(r.FormValue("n"))
+			if err != nil || n < 0 || path == "/nth" && n < 1 {
+				http.Error(w, "bad argument", http.StatusBadRequest)
+				return
+			}
+			if n > limit {
+				http.Error(w, "argument too large", http.StatusBadRequest)
+				return
+			}
+			b, err := json.Marshal(f(n))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(append(b, '\n')); err != nil {
+				fmt.Fprintln(os.Stderr, r.URL, err)
+			}
+		})
+	}
+	handle("/nth", serveLimit, func(n int) interface{} {
+		return map[string]int{"n": n, "prime": shared.nth(n)}
+	})
+	handle("/upto", serveLimit, func(n int) interface{} {
+		return map[string]interface{}{"n": n, "primes": shared.upTo(n)}
+	})
+	handle("/isprime", math.MaxInt, func(n int) interface{} {
+		return map[string]interface{}{"n": n, "prime": isPrime64(n)}
+	})
+	return mux
+}
+
+// Answer the commands "nth n" and "upto n", read one per line from c,
+// by writing the nth prime or the primes <= n one per line.
+// Return when reading from c fails or reaches EOF, which also abandons
+// the command being answered and stops its sieve, so a client that
+// hangs up does not leave a sieve running.
+func ServeConn(c net.Conn) error {
+	defer c.Close()
+	lines := make(chan string)
+	hangup := make(chan struct{}) // closed once reading from c ends
+	quit := make(chan struct{})
+	defer close(quit)
+	var rerr error
+	go func() {
+		defer close(hangup)
+		r := bufio.NewScanner(c)
+		for r.Scan() {
+			select {
+			case lines <- r.Text():
+			case <-quit:
+				return
+			}
+		}
+		rerr = r.Err()
+	}()
+	w := bufio.NewWriter(c)
+	for {
+		var line string
+		select {
+		case line = <-lines:
+		case <-hangup:
+			return rerr
+		}
+		var cmd string
+		var n int
+		_, err := fmt.Sscan(line, &cmd, &n)
+		if err == nil && (cmd == "nth" && n >= 1 || cmd == "upto") {
+			err = streamprimes(w, cmd, n, hangup)
+		} else {
+			_, err = fmt.Fprintln(w, "bad argument")
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write the nth prime, or the primes <= n, to w, unless hangup is closed
+// first.
+func streamprimes(w io.Writer, cmd string, n int, hangup <-chan struct{}) error {
+	primes, stop := stoppable(allPrimes)
+	defer stop()
+	next := func() (int, bool) {
+		select {
+		case p := <-primes:
+			return p, true
+		case <-hangup:
+			return 0, false
+		}
+	}
+	if cmd == "nth" {
+		for i := 1; i < n; i++ {
+			if _, ok := next(); !ok {
+				return nil
+			}
+		}
+		p, ok := next()
+		if !ok {
+			return nil
+		}
+		_, err := fmt.Fprintln(w, p)
+		return err
+	}
+	for p, ok := next(); ok && p <= n; p, ok = next() {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Complain about the command line and exit.
+func badarg() {
+	fmt.Fprintln(os.Stderr, "bad argument")
+	os.Exit(1)
+}
+
+// Parse args as ints no less than min.
+func intargs(args []string, min int) []int {
+	if len(args) == 0 {
+		badarg()
+	}
+	ns := make([]int, len(args))
+	for i, a := range args {
+		n, err := strconv.Atoi(a)
+		if err != nil || n < min {
+			badarg()
+		}
+		ns[i] = n
+	}
+	return ns
+}
+
+// Print whether each of ns is prime.
+// Return false if any of them is not.
+func testargs(w io.Writer, ns []int) bool {
+	all := true
+	for _, n := range ns {
+		ok := IsPrime(n)
+		fmt.Fprintln(w, ok)
+		all = all && ok
+	}
+	return all
+}
+
+// Print the prime factorization of each of ns, like 2^3 * 3^2 * 5.
+func factorargs(w io.Writer, ns []int) {
+	for _, n := range ns {
+		var terms []string
+		for _, f := range Factorize(n) {
+			if f[1] == 1 {
+				terms = append(terms, strconv.Itoa(f[0]))
+			} else {
+				terms = append(terms, fmt.Sprintf("%d^%d", f[0], f[1]))
+			}
+		}
+		if len(terms) == 0 {
+			terms = append(terms, "1")
+		}
+		fmt.Fprintln(w, strings.Join(terms, " * "))
+	}
+}
+
+// Report the heap memory in use on stderr.
+func reportmem() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(os.Stderr, "heap in use: %d bytes\n", m.HeapInuse)
+}
+
+// Return the writer of the output, buffered, to stdout and to the file
+// given by -tee if any, and a func flushing it and closing the file.
+func output() (io.Writer, func()) {
+	stdout := bufio.NewWriter(os.Stdout)
+	if *tee == "" {
+		return stdout, func() { stdout.Flush() }
+	}
+	f, err := os.Create(*tee)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	file := bufio.NewWriter(f)
+	return io.MultiWriter(stdout, file), func() {
+		stdout.Flush()
+		err := file.Flush()
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// Print p, the ith prime, in the output format.
+func printprime(w io.Writer, i, p int) {
+	switch *format {
+	case "jsonl":
+		fmt.Fprintf(w, "{\"index\":%d,\"prime\":%d}\n", i, p)
+	default:
+		fmt.Fprintln(w, textprime(i, p))
+	}
+}
+
+// Return the text form of the ith prime p.
+func textprime(i, p int) string {
+	if *rank {
+		return strconv.Itoa(i) + ": " + strconv.Itoa(p)
+	}
+	return strconv.Itoa(p)
+}
+
+// A printer of primes k per line, right-aligned to width, as for -cols.
+type columns struct {
+	w        io.Writer
+	k, width int
+	n        int // the number of primes printed
+}
+
+// Print p, the ith prime.
+func (c *columns) print(i, p int) {
+	if c.n%c.k != 0 {
+		fmt.Fprint(c.w, " ")
+	}
+	fmt.Fprintf(c.w, "%*s", c.width, textprime(i, p))
+	if c.n++; c.n%c.k == 0 {
+		fmt.Fprintln(c.w)
+	}
+}
+
+// End the last line, if it is not full.
+func (c *columns) end() {
+	if c.n%c.k != 0 {
+		fmt.Fprintln(c.w)
+	}
+}
+
+// Return the width of the text of the largest prime <= n, the widest of
+// the primes printed up to n, for n >= 2.  Counting the primes below a
+// power of 10 tells the number of its digits without finding it.
+func colwidth(n int) int {
+	d := len(strconv.Itoa(n))
+	pi := PiFast(n)
+	if PiFast(int(math.Pow10(d-1))-1) == pi {
+		d--
+	}
+	return len(textprime(pi, int(math.Pow10(d-1))))
+}
+
+func main() {
+	flag.Parse()
+	w, flush := output()
+	defer flush()
+	if *test {
+		if !testargs(w, intargs(flag.Args(), math.MinInt)) {
+			flush()
+			os.Exit(1)
+		}
+		return
+	}
+	if *httpAddr != "" {
+		runtime.GOMAXPROCS(*nCPU)
+		if err := http.ListenAndServe(*httpAddr, handler()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *factor {
+		factorargs(w, intargs(flag.Args(), 1))
+		return
+	}
+	if *format != "text" && *format != "jsonl" || *cols < 0 ||
+		*cols > 0 && *format != "text" {
+		badarg()
+	}
+	n, err := strconv.Atoi(flag.Arg(0))
+	if *count <= 0 {
+		if err != nil || *nth && n < 1 {
+			badarg()
+		}
+		if !*nth && !*countonly && n < 2 {
+			// nothing to print: don't start the sieve at all
+			return
+		}
+	}
+	runtime.GOMAXPROCS(*nCPU)
+	if *mem {
+		defer reportmem()
+	}
+	if *histogram {
+		printgaps(w, *start, n)
+		return
+	}
+	if *countonly {
+		fmt.Fprintln(w, max(PiFast(n)-PiFast(*start-1), 0))
+		return
+	}
+	if *nth && *count <= 0 && *start <= 2 {
+		printprime(w, n, Nth(n))
+		return
+	}
+	primes := annotate(nil)
+	var i, p int // p is the ith prime
+	next := func() {
+		e := <-primes
+		i, p = e.Index, e.Prime
+	}
+	next()
+	for p < *start {
+		next()
+	}
+	var col *columns
+	if *cols > 0 {
+		col = &columns{w: w, k: *cols}
+	}
+	// -cols needs the widest prime printed, which is known up front only
+	// when printing up to n
+	hold := *reverse || col != nil && (*count > 0 || *nth)
+	if col != nil && !hold {
+		col.width = colwidth(n)
+	}
+	var held [][2]int // the primes held back by -reverse or -cols
+	emit := func() {
+		switch {
+		case hold:
+			held = append(held, [2]int{i, p})
+		case col != nil:
+			col.print(i, p)
+		default:
+			printprime(w, i, p)
+		}
+	}
+	if *count > 0 {
+		for k := 0; k < *count; k++ {
+			emit()
+			next()
+		}
+	} else if *nth {
+		for k := 1; k < n; k++ {
+			next()
+		}
+		emit()
+	} else {
+		for p <= n {
+			emit()
+			next()
+		}
+	}
+	if *reverse {
+		slices.Reverse(held)
+	}
+	if col == nil {
+		for _, h := range held {
+			printprime(w, h[0], h[1])
+		}
+		return
+	}
+	for _, h := range held {
+		col.width = max(col.width, len(textprime(h[0], h[1])))
+	}
+	for _, h := range held {
+		col.print(h[0], h[1])
 	}
+	col.end()
 }
@@ -0,0 +1,1799 @@
+// Copyright 2009 Anh Hai Trinh. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Tests of sieve3.go, run with
+//
+//	go test sieve3.go sieve3_test.go
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// If GOSIEVE_ARGS is set, the test binary is the program itself, run by
+// sieve3 with those arguments, instead of the tests.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("GOSIEVE_ARGS"); ok {
+		os.Args = append([]string{"sieve3"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Run the program with args and return its output and exit status.
+func sieve3(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GOSIEVE_ARGS="+strings.Join(args, " "))
+	out, err := cmd.Output()
+	var failed *exec.ExitError
+	if errors.As(err, &failed) {
+		return string(out), failed.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// Run the program with args and fail unless it prints want and exits 0.
+func expect(t *testing.T, want string, args ...string) {
+	t.Helper()
+	if got, code := sieve3(t, args...); got != want || code != 0 {
+		t.Errorf("sieve3 %v = %q, exit %d; want %q, exit 0", args, got, code, want)
+	}
+}
+
+// Return the next k values received from ch.
+func take[T any](ch <-chan T, k int) []T {
+	vs := make([]T, k)
+	for i := range vs {
+		vs[i] = <-ch
+	}
+	return vs
+}
+
+// Time consuming the primes <= n from the chan made by mk, whose sieve is
+// stopped once done is closed after each iteration.  Only the consuming is
+// timed, so that different sieves are compared on the same work.
+func benchN(b *testing.B, n int, mk func(done <-chan struct{}) <-chan int) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		done := make(chan struct{})
+		primes := mk(done)
+		b.StartTimer()
+		for p := <-primes; p <= n; p = <-primes {
+		}
+		b.StopTimer()
+		close(done)
+	}
+}
+
+// Return a func making a sieve with the options in c, for benchN.
+func withConfig(c Config) func(done <-chan struct{}) <-chan int {
+	conf := c.withDefaults()
+	return func(done <-chan struct{}) <-chan int { return sieve(conf, done) }
+}
+
+var heapFlag = flag.Bool("heap", false, "run TestHeapInUse")
+
+// Return the number of goroutines running once it has stopped changing,
+// as the sieves that earlier tests leave running fill their buffers.
+func goroutines() int {
+	n := runtime.NumGoroutine()
+	for {
+		time.Sleep(20 * time.Millisecond)
+		m := runtime.NumGoroutine()
+		if m == n {
+			return n
+		}
+		n = m
+	}
+}
+
+// Fail unless the goroutines running drop back to n.  The goroutines of a
+// stopped sieve take a moment to unwind, so it waits for up to a second.
+func settles(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if k := runtime.NumGoroutine() - n; k > 0 {
+		t.Errorf("%d goroutines left running", k)
+	}
+}
+
+// Return the primes <= n by the sieve of Eratosthenes on an array, as an
+// oracle for the channel sieve.
+func eratosthenes(n int) []int {
+	composite := make([]bool, n+1)
+	var ps []int
+	for i := 2; i <= n; i++ {
+		if !composite[i] {
+			ps = append(ps, i)
+			for j := i * i; j <= n; j += i {
+				composite[j] = true
+			}
+		}
+	}
+	return ps
+}
+
+func TestReciprocalSum(t *testing.T) {
+	// the sum of 1/p over the 25 primes <= 100
+	if got, want := ReciprocalSum(100), 1.8028172010488706; math.Abs(got-want) > 1e-12 {
+		t.Errorf("ReciprocalSum(100) = %v, want %v", got, want)
+	}
+	if got := ReciprocalSum(1); got != 0 {
+		t.Errorf("ReciprocalSum(1) = %v, want 0", got)
+	}
+}
+
+func TestFactorialPrimes(t *testing.T) {
+	var got []int
+	for p := range FactorialPrimes(1000000, nil) {
+		got = append(got, p)
+	}
+	// 1!+1, 2!+1, 3!-1, 3!+1, 4!-1, 6!-1, 7!-1
+	if want := []int{2, 3, 5, 7, 23, 719, 5039}; !slices.Equal(got, want) {
+		t.Errorf("FactorialPrimes(10^6) = %v, want %v", got, want)
+	}
+}
+
+func TestPrimorialPrimes(t *testing.T) {
+	var got []int
+	for p := range PrimorialPrimes(1000000, nil) {
+		got = append(got, p)
+	}
+	// 2#+1, 3#-1, 3#+1, 5#-1, 5#+1, 7#+1, 11#-1, 11#+1, 13#-1
+	if want := []int{3, 5, 7, 29, 31, 211, 2309, 2311, 30029}; !slices.Equal(got, want) {
+		t.Errorf("PrimorialPrimes(10^6) = %v, want %v", got, want)
+	}
+}
+
+func TestStart(t *testing.T) {
+	expect(t, "97\n101\n", "-start", "90", "-count", "2")
+	expect(t, "11\n13\n", "-start", "10", "13")
+}
+
+func TestGapsFlag(t *testing.T) {
+	// the gaps between the primes <= 47: 2 follows 3, 5, 11, 17, 29 and 41
+	expect(t, "1 1\n2 6\n4 5\n6 2\n", "-gaps", "50")
+}
+
+// A Logger counting the events it is notified of.
+type countingLogger struct {
+	sync.Mutex
+	events map[string]int
+}
+
+func (l *countingLogger) Log(event string, n int) {
+	l.Lock()
+	defer l.Unlock()
+	l.events[event]++
+}
+
+func TestLogger(t *testing.T) {
+	log := &countingLogger{events: make(map[string]int)}
+	g, err := NewGenerator(Config{Logger: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 10000 {
+		g.Next()
+	}
+	g.Stop()
+	log.Lock()
+	defer log.Unlock()
+	for _, event := range []string{"spin", "multiples", "heap", "sendproxy", "exit"} {
+		if log.events[event] == 0 {
+			t.Errorf("no %q event in %v", event, log.events)
+		}
+	}
+}
+
+// The default buffer sizes, which grow with GOMAXPROCS, against the fixed
+// sizes they replaced.
+func BenchmarkBufsize(b *testing.B) {
+	b.Run("default", func(b *testing.B) { benchN(b, 1000000, withConfig(Config{})) })
+	b.Run("fixed", func(b *testing.B) {
+		benchN(b, 1000000, withConfig(Config{Bufsize: 1024, CompositeBuf: 8046}))
+	})
+}
+
+func TestFirst(t *testing.T) {
+	if got, want := First(5), []int{2, 3, 5, 7, 11}; !slices.Equal(got, want) {
+		t.Errorf("First(5) = %v, want %v", got, want)
+	}
+	if got := First(0); got == nil || len(got) != 0 {
+		t.Errorf("First(0) = %#v, want an empty slice", got)
+	}
+	if got := First(1000); len(got) != 1000 || got[999] != 7919 {
+		t.Errorf("First(1000) has %d primes, the last %d", len(got), got[len(got)-1])
+	}
+}
+
+func TestByIndexParity(t *testing.T) {
+	if got, want := take(ByIndexParity(true), 5), []int{2, 5, 11, 17, 23}; !slices.Equal(got, want) {
+		t.Errorf("ByIndexParity(true) = %v, want %v", got, want)
+	}
+	if got, want := take(ByIndexParity(false), 5), []int{3, 7, 13, 19, 29}; !slices.Equal(got, want) {
+		t.Errorf("ByIndexParity(false) = %v, want %v", got, want)
+	}
+}
+
+func TestRollingProductMod(t *testing.T) {
+	got := take(RollingProductMod(1000), 10)
+	if want := []int{2, 6, 30, 210, 310, 30, 510, 690, 870, 230}; !slices.Equal(got, want) {
+		t.Errorf("RollingProductMod(1000) = %v, want %v", got, want)
+	}
+	if got := take(RollingProductMod(1), 3); !slices.Equal(got, []int{0, 0, 0}) {
+		t.Errorf("RollingProductMod(1) = %v, want zeros", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("RollingProductMod(0) did not panic")
+		}
+	}()
+	RollingProductMod(0)
+}
+
+func TestSmallN(t *testing.T) {
+	expect(t, "", "0")
+	expect(t, "", "1")
+	expect(t, "2\n", "2")
+}
+
+func TestTestFlag(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		out  string
+		code int
+	}{
+		{[]string{"-test", "97"}, "true\n", 0},
+		{[]string{"-test", "91"}, "false\n", 1},
+		{[]string{"-test", "97", "91", "2"}, "true\nfalse\ntrue\n", 1},
+	} {
+		if out, code := sieve3(t, c.args...); out != c.out || code != c.code {
+			t.Errorf("sieve3 %v = %q, exit %d; want %q, exit %d", c.args, out, code, c.out, c.code)
+		}
+	}
+}
+
+func TestFactorFlag(t *testing.T) {
+	expect(t, "2^3 * 3^2 * 5\n1\n17\n", "-factor", "360", "1", "17")
+}
+
+func TestReverse(t *testing.T) {
+	expect(t, "19\n17\n13\n11\n7\n5\n3\n2\n", "-reverse", "20")
+}
+
+// The sieve of sieve3.go over the odd numbers, the candidates of sieve2.go,
+// against its 2, 3, 5, 7 wheel.  sieve2.go itself declares the same names
+// in package main, so it cannot be linked into this test.
+func BenchmarkSieve(b *testing.B) {
+	b.Run("odds", func(b *testing.B) {
+		benchN(b, 1000000, withConfig(Config{WheelPrimes: []int{2}}))
+	})
+	b.Run("wheel", func(b *testing.B) { benchN(b, 1000000, withConfig(Config{})) })
+}
+
+// Report the heap in use once the sieve has reached 10^7, with the
+// feedback loop of Sieve(), which buffers nearly every prime found, and
+// with the base primes from a second sieve, as Nth does.  Run with
+//
+//	go test -run HeapInUse -v sieve3.go sieve3_test.go -heap
+func TestHeapInUse(t *testing.T) {
+	if !*heapFlag {
+		t.Skip("-heap not given")
+	}
+	for _, c := range []struct {
+		name string
+		mk   func(done <-chan struct{}) chan int
+	}{
+		{"feedback", allPrimes},
+		{"base sieve", func(done <-chan struct{}) chan int {
+			base := Config{}.withDefaults()
+			conf := *base
+			conf.BasePrimes = primesAfter(conf.wheel.prime-1, base, done)
+			return sieve(&conf, done)
+		}},
+	} {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		primes, stop := stoppable(c.mk)
+		for p := <-primes; p < 10000000; p = <-primes {
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		stop()
+		goroutines() // let the sieve unwind before the next
+		t.Logf("%s: heap in use %d bytes", c.name, int64(after.HeapInuse)-int64(before.HeapInuse))
+	}
+}
+
+// Run with -race, which the single-CPU default would not exercise.
+func TestMultiCore(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	n := goroutines()
+	g, err := NewGenerator(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := 0
+	for i := range 100000 {
+		if p := g.Next(); p <= last {
+			t.Fatalf("prime %d is %d, after %d", i+1, p, last)
+		} else {
+			last = p
+		}
+	}
+	if last != 1299709 {
+		t.Errorf("prime 100000 is %d, want 1299709", last)
+	}
+	g.Stop()
+	settles(t, n)
+}
+
+// PrimesUpTo, First and IsPrime answer from smallPrimes below smallLimit
+// and from the sieve above; they must agree across the boundary.
+func TestSmallPrimes(t *testing.T) {
+	want := eratosthenes(2 * smallLimit)
+	for n := smallLimit - 10; n <= smallLimit+10; n++ {
+		if got, want := PrimesUpTo(n), want[:sort.SearchInts(want, n+1)]; !slices.Equal(got, want) {
+			t.Errorf("PrimesUpTo(%d) differs from the sieve: %v", n, got[len(got)-3:])
+		}
+	}
+	for k := len(smallPrimes) - 2; k <= len(smallPrimes)+2; k++ {
+		if got := First(k); !slices.Equal(got, want[:k]) {
+			t.Errorf("First(%d) ends with %v, want %v", k, got[k-2:], want[k-2:k])
+		}
+	}
+	for n := -1; n <= 2*smallLimit; n++ {
+		if _, ok := slices.BinarySearch(want, n); IsPrime(n) != ok {
+			t.Errorf("IsPrime(%d) = %v", n, !ok)
+		}
+	}
+}
+
+func TestGapsAtLeast(t *testing.T) {
+	got := GapsAtLeast(8, 200)
+	if want := [][2]int{{89, 8}, {113, 14}, {139, 10}, {181, 10}}; !slices.Equal(got, want) {
+		t.Errorf("GapsAtLeast(8, 200) = %v, want %v", got, want)
+	}
+}
+
+func TestPascalModP(t *testing.T) {
+	got := PascalModP(3, 4)
+	want := [][]int{{1}, {1, 1}, {1, 2, 1}, {1, 0, 0, 1}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("PascalModP(3, 4) = %v, want %v", got, want)
+	}
+	if got := PascalModP(4, 4); got != nil {
+		t.Errorf("PascalModP(4, 4) = %v, want nil", got)
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	out, code := sieve3(t, "-format", "jsonl", "100")
+	if code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+	d := json.NewDecoder(strings.NewReader(out))
+	for i, want := range []int{2, 3, 5} {
+		var v struct{ Index, Prime int }
+		if err := d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if v.Index != i+1 || v.Prime != want {
+			t.Errorf("line %d = %+v, want index %d, prime %d", i+1, v, i+1, want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := httptest.NewServer(handler())
+	defer s.Close()
+	for _, c := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/nth?n=10", 200, `{"n":10,"prime":29}`},
+		{"/upto?n=20", 200, `{"n":20,"primes":[2,3,5,7,11,13,17,19]}`},
+		{"/isprime?n=97", 200, `{"n":97,"prime":true}`},
+		{"/isprime?n=4611686018427387847", 200, `{"n":4611686018427387847,"prime":true}`},
+		{"/nth?n=0", 400, "bad argument"},
+		{"/upto?n=x", 400, "bad argument"},
+		{"/upto?n=1000001", 400, "argument too large"},
+	} {
+		resp, err := http.Get(s.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(body)); resp.StatusCode != c.code || got != c.body {
+			t.Errorf("GET %s = %d %s, want %d %s", c.path, resp.StatusCode, got, c.code, c.body)
+		}
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	n := goroutines()
+	client, server := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- ServeConn(server) }()
+	r := bufio.NewReader(client)
+	for _, c := range []struct{ cmd, want string }{
+		{"nth 10\n", "29\n"},
+		{"upto 10\n", "2\n3\n5\n7\n"},
+		{"sieve 10\n", "bad argument\n"},
+	} {
+		if _, err := io.WriteString(client, c.cmd); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(c.want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.want {
+			t.Errorf("%q answered %q, want %q", c.cmd, got, c.want)
+		}
+	}
+
+	// hang up in the middle of a command that would never end
+	io.WriteString(client, "upto 1000000000000\n")
+	if line, err := r.ReadString('\n'); line != "2\n" {
+		t.Errorf("upto answered %q, %v", line, err)
+	}
+	client.Close()
+	select {
+	case <-errc:
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn did not return after the client hung up")
+	}
+	settles(t, n)
+}
+
+func TestSquares(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	if got, want := take(squares(done), 5), []int{4, 9, 25, 49, 121}; !slices.Equal(got, want) {
+		t.Errorf("Squares() = %v, want %v", got, want)
+	}
+}
+
+func TestPrimeZeta(t *testing.T) {
+	// the sum of 1/p^2 over the 25 primes <= 100
+	if got, want := PrimeZeta(2, 100), 0.45042878826375243; math.Abs(got-want) > 1e-12 {
+		t.Errorf("PrimeZeta(2, 100) = %v, want %v", got, want)
+	}
+}
+
+func TestPrimeStride(t *testing.T) {
+	for n := 1; n <= 100; n++ {
+		stride := PrimeStride(n)
+		seen := make([]bool, n)
+		for k, i := 0, 0; k < n; k, i = k+1, (i+stride)%n {
+			if seen[i] {
+				t.Fatalf("PrimeStride(%d) = %d visits %d twice", n, stride, i)
+			}
+			seen[i] = true
+		}
+	}
+	if got := PrimeStride(10); got != 7 {
+		t.Errorf("PrimeStride(10) = %d, want 7", got)
+	}
+	if got := PrimeStride(0); got != 0 {
+		t.Errorf("PrimeStride(0) = %d, want 0", got)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	n := goroutines()
+	done := make(chan struct{})
+	got := take(candidates(done), 10)
+	if want := []int{13, 17, 19, 23, 29, 31, 37, 41, 43, 47}; !slices.Equal(got, want) {
+		t.Errorf("Candidates() = %v, want %v", got, want)
+	}
+	close(done)
+	settles(t, n)
+}
+
+func TestAuto(t *testing.T) {
+	for _, n := range []int{AutoThreshold - 1, AutoThreshold, 10 * AutoThreshold} {
+		q := 2
+		for p := range Auto(n) {
+			for ; q < p; q++ {
+				if isPrime64(q) {
+					t.Fatalf("Auto(%d) skipped %d", n, q)
+				}
+			}
+			if !isPrime64(p) {
+				t.Fatalf("Auto(%d) gave %d", n, p)
+			}
+			q = p + 1
+		}
+		for ; q <= n; q++ {
+			if isPrime64(q) {
+				t.Fatalf("Auto(%d) stopped before %d", n, q)
+			}
+		}
+	}
+}
+
+func BenchmarkAuto(b *testing.B) {
+	for _, n := range []int{100, 300, 500, 700, 1000, 4000} {
+		for _, c := range []struct {
+			name  string
+			wheel []int
+		}{{"odds", []int{2}}, {"wheel", nil}} {
+			conf := Config{WheelPrimes: c.wheel}.withDefaults()
+			b.Run(fmt.Sprintf("n=%d/%s", n, c.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					done := make(chan struct{})
+					primes := sieve(conf, done)
+					for p := <-primes; p <= n; p = <-primes {
+					}
+					close(done)
+				}
+			})
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	g, err := NewGenerator(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	next := func() []int {
+		ps := make([]int, 1000)
+		for i := range ps {
+			ps[i] = g.Next()
+		}
+		return ps
+	}
+	first := next()
+	g.Reset()
+	if again := next(); !slices.Equal(again, first) {
+		t.Fatalf("after Reset, the primes are %v..., want %v...", again[:5], first[:5])
+	}
+	reset := testing.AllocsPerRun(10, func() {
+		g.Reset()
+		for range 1000 {
+			g.Next()
+		}
+	})
+	fresh := testing.AllocsPerRun(10, func() {
+		g, err := NewGenerator(Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 1000 {
+			g.Next()
+		}
+		g.Stop()
+	})
+	if reset >= fresh {
+		t.Errorf("Reset made %v allocations, a new Generator %v", reset, fresh)
+	}
+}
+
+func BenchmarkReset(b *testing.B) {
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			g, err := NewGenerator(Config{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for range 1000 {
+				g.Next()
+			}
+			g.Stop()
+		}
+	})
+	b.Run("reset", func(b *testing.B) {
+		b.ReportAllocs()
+		g, err := NewGenerator(Config{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer g.Stop()
+		for i := 0; i < b.N; i++ {
+			g.Reset()
+			for range 1000 {
+				g.Next()
+			}
+		}
+	})
+}
+
+func TestMaxPrime(t *testing.T) {
+	want := map[int]int{32: 1<<31 - 1, 64: 1<<63 - 25}[strconv.IntSize]
+	if got := MaxPrime(); got != want {
+		t.Errorf("MaxPrime() = %d, want %d", got, want)
+	}
+}
+
+func TestIsAdmissible(t *testing.T) {
+	for _, c := range []struct {
+		pattern []int
+		want    bool
+	}{
+		{[]int{0, 2}, true},
+		{[]int{0, 2, 4}, false}, // covers 0, 1, 2 mod 3
+		{[]int{0, 2, 6}, true},
+		{[]int{0, 2, 6, 8}, true},
+		{[]int{0, 1}, false}, // covers 0, 1 mod 2
+	} {
+		if got := IsAdmissible(c.pattern); got != c.want {
+			t.Errorf("IsAdmissible(%v) = %v, want %v", c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestGapCDF(t *testing.T) {
+	cdf := GapCDF(50)
+	last := cdf[len(cdf)-1]
+	if last.Gap != 6 || last.Frac != 1 {
+		t.Errorf("GapCDF(50) ends with %+v, want {Gap:6 Frac:1}", last)
+	}
+	for i := 1; i < len(cdf); i++ {
+		if cdf[i].Gap <= cdf[i-1].Gap || cdf[i].Frac <= cdf[i-1].Frac {
+			t.Errorf("GapCDF(50) = %v is not increasing", cdf)
+		}
+	}
+}
+
+// Feed merge the primes from 11 to 997 and check that it yields the
+// composites coprime to 210 up to 997^2 in order.
+func TestBasePrimes(t *testing.T) {
+	conf := Config{}.withDefaults()
+	base := make(chan int, len(smallPrimes))
+	for _, p := range smallPrimes[4:] {
+		base <- p
+	}
+	ps := newPipes(conf)
+	ps.wg.Add(1)
+	done := make(chan struct{})
+	composites := merge(base, nil, conf, ps, done)
+	primes := eratosthenes(100000)
+	c := <-composites
+	for n := 11; n <= 100000; n++ {
+		if _, prime := slices.BinarySearch(primes, n); prime || !CoprimeTo210(n) {
+			continue
+		}
+		if c != n {
+			t.Fatalf("composite %d, want %d", c, n)
+		}
+		for c == n {
+			c = <-composites
+		}
+	}
+	close(done)
+	ps.wg.Wait()
+	done = make(chan struct{})
+	defer close(done)
+
+	// and the sieve, from the same primes
+	base = make(chan int, len(smallPrimes))
+	for _, p := range smallPrimes[4:] {
+		base <- p
+	}
+	got := sieve(Config{BasePrimes: base}.withDefaults(), done)
+	for i, want := range primes {
+		if p := <-got; p != want {
+			t.Fatalf("prime %d is %d, want %d", i+1, p, want)
+		}
+	}
+
+	// but not a Generator, which could not restart from them
+	if g, err := NewGenerator(Config{BasePrimes: base}); err == nil {
+		g.Stop()
+		t.Error("NewGenerator with BasePrimes did not fail")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	g, err := NewGenerator(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	for range 100000 {
+		g.Next()
+	}
+	f, err := os.CreateTemp(t.TempDir(), "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := g.SnapshotTo(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	h, err := RestoreFrom(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Stop()
+	for i := range 10000 {
+		if p, q := g.Next(), h.Next(); p != q {
+			t.Fatalf("prime %d after the snapshot is %d, restored %d", i+1, q, p)
+		}
+	}
+	for _, bad := range []string{
+		"basis 3\nlast 10\n",
+		"basis 2 3 5 7 11 13 17 19 23 29 31\nlast 10\n",
+		"basis 2 3 5 7\nlast 1000\n11 120\n",
+	} {
+		if _, err := RestoreFrom(strings.NewReader(bad)); err == nil {
+			t.Errorf("RestoreFrom(%q) did not fail", bad)
+		}
+	}
+}
+
+// Return the output of another of the sieve programs, such as sieve2.go,
+// run with args.
+func gorun(t *testing.T, file string, args ...string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds " + file)
+	}
+	out, err := exec.Command("go", append([]string{"run", file}, args...)...).Output()
+	if err != nil {
+		t.Fatalf("go run %s %v: %v", file, args, err)
+	}
+	return string(out)
+}
+
+// The output of sieve2.go against that of sieve3.go, to 10^6.
+func TestSieve2(t *testing.T) {
+	want := strings.Split(gorun(t, "sieve2.go", "1000000"), "\n")
+	out, _ := sieve3(t, "1000000")
+	got := strings.Split(out, "\n")
+	for i := range min(len(got), len(want)) {
+		if got[i] != want[i] {
+			t.Fatalf("prime %d is %s by sieve3.go, %s by sieve2.go", i+1, got[i], want[i])
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("sieve3.go prints %d lines, sieve2.go %d", len(got), len(want))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Bufsize: -1},
+		{CompositeBuf: -1},
+		{MultiplesBuf: -1},
+		{MaxLiveMultiples: -1},
+		{WheelPrimes: []int{3}},
+		{WheelPrimes: []int{2, 5}},
+		{WheelPrimes: []int{2, 3, 5, 7, 11, 13, 17, 19, 23}},
+	} {
+		if primes, err := SieveWith(c); err == nil || primes != nil {
+			t.Errorf("SieveWith(%+v) = %v, %v; want an error", c, primes, err)
+		}
+		if g, err := NewGenerator(c); err == nil || g != nil {
+			t.Errorf("NewGenerator(%+v) = %v, %v; want an error", c, g, err)
+		}
+	}
+	for _, c := range []Config{{}, {WheelPrimes: []int{}}, {WheelPrimes: []int{2, 3}}} {
+		if err := c.validate(); err != nil {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+}
+
+func TestPiFast(t *testing.T) {
+	for x, want := range map[int]int{1: 0, 2: 1, 100: 25, 1000000: 78498, 100000000: 5761455} {
+		if got := PiFast(x); got != want {
+			t.Errorf("PiFast(%d) = %d, want %d", x, got, want)
+		}
+	}
+	primes := eratosthenes(5000)
+	for x := 0; x <= 5000; x++ {
+		if got, want := PiFast(x), sort.SearchInts(primes, x+1); got != want {
+			t.Fatalf("PiFast(%d) = %d, want %d", x, got, want)
+		}
+	}
+}
+
+func TestEnumerated(t *testing.T) {
+	n := goroutines()
+	var last int
+	for i, p := range Enumerated() {
+		if i == 5 {
+			last = p
+			break
+		}
+	}
+	if last != 11 {
+		t.Errorf("the 5th prime is %d, want 11", last)
+	}
+	settles(t, n)
+}
+
+func TestAnomalousGaps(t *testing.T) {
+	got := AnomalousGaps(200, 1)
+	if want := [][2]int{{7, 4}, {113, 14}, {139, 10}}; !slices.Equal(got, want) {
+		t.Errorf("AnomalousGaps(200, 1) = %v, want %v", got, want)
+	}
+	if got := AnomalousGaps(200, 0.5); !slices.Contains(got, [2]int{89, 8}) {
+		t.Errorf("AnomalousGaps(200, 0.5) = %v, without {89 8}", got)
+	}
+}
+
+func TestCols(t *testing.T) {
+	expect(t, "2 3 5 7\n", "-cols", "4", "10")
+	expect(t, " 2  3  5  7\n11 13 17 19\n", "-cols", "4", "20")
+	expect(t, " 2  3  5\n 7 11 13\n", "-cols", "3", "-start", "2", "16")
+	expect(t, " 97 101 103 107\n109 113\n", "-cols", "4", "-count", "6", "-start", "90")
+}
+
+func TestRank(t *testing.T) {
+	out, code := sieve3(t, "-rank", "100")
+	lines := strings.SplitAfter(out, "\n")
+	if got := strings.Join(lines[:3], ""); got != "1: 2\n2: 3\n3: 5\n" || code != 0 {
+		t.Errorf("sieve3 -rank 100 begins %q, exit %d", got, code)
+	}
+}
+
+func TestNthContext(t *testing.T) {
+	n := goroutines()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p, err := NthContext(ctx, 100000000); err != context.Canceled {
+		t.Errorf("NthContext(cancelled) = %d, %v", p, err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if p, err := NthContext(ctx, 100000000); err != context.DeadlineExceeded {
+		t.Errorf("NthContext(10ms) = %d, %v", p, err)
+	}
+	if p, err := NthContext(context.Background(), 25); p != 97 || err != nil {
+		t.Errorf("NthContext(25) = %d, %v; want 97", p, err)
+	}
+	settles(t, n)
+}
+
+func TestSieveTo(t *testing.T) {
+	out := make(chan int, 8)
+	done := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		SieveTo(out, done)
+		close(returned)
+	}()
+	for len(out) < cap(out) {
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	<-returned
+	close(out) // safe: SieveTo sends nothing more once it has returned
+	var got []int
+	for p := range out {
+		got = append(got, p)
+	}
+	if want := []int{2, 3, 5, 7, 11, 13, 17, 19}; !slices.Equal(got, want) {
+		t.Errorf("SieveTo filled %v, want %v", got, want)
+	}
+}
+
+func TestSumOfPrimeFactors(t *testing.T) {
+	got := SumOfPrimeFactors(30)
+	if want := []int{0, 0, 2, 3, 4, 5, 5, 7, 6, 6, 7, 11, 7}; !slices.Equal(got[:13], want) {
+		t.Errorf("SumOfPrimeFactors(30)[:13] = %v, want %v", got[:13], want)
+	}
+	if got[30] != 10 {
+		t.Errorf("sopfr(30) = %d, want 10", got[30])
+	}
+}
+
+// The nth prime by counting the output of Sieve(), whose feedback loop
+// buffers nearly every prime below it, and by Nth, which does not.
+func BenchmarkNth(b *testing.B) {
+	const n = 1000000
+	b.Run("feedback", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			primes, stop := stoppable(allPrimes)
+			for range n {
+				<-primes
+			}
+			stop()
+		}
+	})
+	b.Run("Nth", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			Nth(n)
+		}
+	})
+}
+
+func TestVerifyGoldbach(t *testing.T) {
+	if n, ok := VerifyGoldbach(10000); !ok {
+		t.Errorf("VerifyGoldbach(10000) fails at %d", n)
+	}
+}
+
+func TestZip(t *testing.T) {
+	a, b := make(chan int, 3), make(chan int, 2)
+	a <- 2
+	a <- 3
+	a <- 5
+	b <- 4
+	b <- 9
+	close(a)
+	close(b)
+	var got [][2]int
+	for v := range Zip(a, b) {
+		got = append(got, v)
+	}
+	if want := [][2]int{{2, 4}, {3, 9}}; !slices.Equal(got, want) {
+		t.Errorf("Zip = %v, want %v", got, want)
+	}
+}
+
+func TestRandomPrimeBelow(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for range 20 {
+		if p := RandomPrimeBelow(100, r); p >= 100 || !IsPrime(p) {
+			t.Errorf("RandomPrimeBelow(100) = %d", p)
+		}
+	}
+	if p := RandomPrimeBelow(2, r); p != 0 {
+		t.Errorf("RandomPrimeBelow(2) = %d, want 0", p)
+	}
+}
+
+func TestQuadruplets(t *testing.T) {
+	ch, stop := stoppable(quadruplets)
+	defer stop()
+	if got, want := take(ch, 2), [][4]int{{5, 7, 11, 13}, {11, 13, 17, 19}}; !slices.Equal(got, want) {
+		t.Errorf("Quadruplets() = %v, want %v", got, want)
+	}
+	got := QuadrupletsUpTo(200)
+	want := [][4]int{{5, 7, 11, 13}, {11, 13, 17, 19}, {101, 103, 107, 109}, {191, 193, 197, 199}}
+	if !slices.Equal(got, want) {
+		t.Errorf("QuadrupletsUpTo(200) = %v, want %v", got, want)
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	for n, want := range map[int][2]int{100: {97, 101}, 2: {0, 3}, 97: {89, 101}, 0: {0, 2}} {
+		if prev, next := Neighbors(n); prev != want[0] || next != want[1] {
+			t.Errorf("Neighbors(%d) = %d, %d; want %d, %d", n, prev, next, want[0], want[1])
+		}
+	}
+}
+
+func TestAPPrimes(t *testing.T) {
+	if ps, ok := APPrimes(5, 6, 5); !ok || !slices.Equal(ps, []int{5, 11, 17, 23, 29}) {
+		t.Errorf("APPrimes(5, 6, 5) = %v, %v", ps, ok)
+	}
+	if ps, ok := APPrimes(5, 6, 6); ok || len(ps) != 5 { // 35 is not prime
+		t.Errorf("APPrimes(5, 6, 6) = %v, %v", ps, ok)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	if got := take(Annotate(), 25)[24]; got.Index != 25 || got.Prime != 97 {
+		t.Errorf("the 25th of Annotate() is %+v, want {Index:25 Prime:97}", got)
+	}
+	n := goroutines()
+	done := make(chan struct{})
+	<-annotate(done)
+	close(done)
+	settles(t, n)
+}
+
+func TestMultiplesBuf(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	primes := sieve(Config{MultiplesBuf: 1}.withDefaults(), done)
+	for i, want := range eratosthenes(100000) {
+		if p := <-primes; p != want {
+			t.Fatalf("prime %d is %d, want %d", i+1, p, want)
+		}
+	}
+}
+
+// The memory taken by the channels of multiples, in B/op, by their size.
+func BenchmarkMultiplesBuf(b *testing.B) {
+	for _, size := range []int{1, 16, 1024} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			benchN(b, 1000000, withConfig(Config{MultiplesBuf: size}))
+		})
+	}
+}
+
+func TestGapMerits(t *testing.T) {
+	ms := GapMerits(1000)
+	for i := 1; i < len(ms); i++ {
+		if ms[i].Prime <= ms[i-1].Prime || ms[i].Merit <= ms[i-1].Merit {
+			t.Errorf("GapMerits(1000) = %v is not increasing", ms)
+		}
+	}
+	if last := ms[len(ms)-1]; last.Prime != 113 {
+		t.Errorf("the record merit below 1000 is at %d, want 113", last.Prime)
+	}
+}
+
+func TestCountOnly(t *testing.T) {
+	expect(t, "25\n", "-countonly", "100")
+	expect(t, "0\n", "-countonly", "1")
+	expect(t, "3\n", "-countonly", "-start", "80", "100")
+}
+
+func TestPopcountPrimes(t *testing.T) {
+	got := take(PopcountPrimes(), 5)
+	if want := [][2]int{{2, 1}, {3, 2}, {5, 2}, {7, 3}, {11, 3}}; !slices.Equal(got, want) {
+		t.Errorf("PopcountPrimes() = %v, want %v", got, want)
+	}
+	// there is no sixth: the filter's sieve must be stopped
+	fermat, stop := stoppable(func(done <-chan struct{}) chan int { return popcountPrimesFilter(2, done) })
+	defer stop()
+	if got, want := take(fermat, 5), []int{3, 5, 17, 257, 65537}; !slices.Equal(got, want) {
+		t.Errorf("PopcountPrimesFilter(2) = %v, want %v", got, want)
+	}
+}
+
+func TestByteStream(t *testing.T) {
+	r := ByteStream()
+	var got []byte
+	buf := make([]byte, 7) // not dividing the total, so reads cross primes
+	for len(got) < 1000 {
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	for i, p := range First(1000) {
+		if got[i] != byte(p) {
+			t.Fatalf("byte %d is %d, want %d%%256", i, got[i], p)
+		}
+	}
+}
+
+func TestPrimePowers(t *testing.T) {
+	got := PrimePowers(20)
+	if want := []int{2, 3, 4, 5, 7, 8, 9, 11, 13, 16, 17, 19}; !slices.Equal(got, want) {
+		t.Errorf("PrimePowers(20) = %v, want %v", got, want)
+	}
+}
+
+func TestSemiPrimes(t *testing.T) {
+	if got, want := SemiPrimes(25), []int{4, 6, 9, 10, 14, 15, 21, 22, 25}; !slices.Equal(got, want) {
+		t.Errorf("SemiPrimes(25) = %v, want %v", got, want)
+	}
+}
+
+func TestSmallestXWithPi(t *testing.T) {
+	if got := SmallestXWithPi(25); got != 97 {
+		t.Errorf("SmallestXWithPi(25) = %d, want 97", got)
+	}
+	if got := PrimeAtCount(1); got != 2 {
+		t.Errorf("PrimeAtCount(1) = %d, want 2", got)
+	}
+	for _, n := range []int{0, -1} {
+		if a, b, c := Nth(n), PrimeAtCount(n), SmallestXWithPi(n); a != 0 || b != 0 || c != 0 {
+			t.Errorf("Nth, PrimeAtCount, SmallestXWithPi(%d) = %d, %d, %d; want 0", n, a, b, c)
+		}
+	}
+}
+
+func TestMaxLiveMultiples(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	primes := sieve(Config{MaxLiveMultiples: 2}.withDefaults(), done)
+	for i, want := range eratosthenes(10000) {
+		if p := <-primes; p != want {
+			t.Fatalf("prime %d is %d, want %d", i+1, p, want)
+		}
+	}
+}
+
+func TestWheelIndex(t *testing.T) {
+	for n, want := range map[int]int{13: 0, 17: 1, 19: 2, 223: 0, 11: 47} {
+		if i, ok := WheelIndex(n); i != want || !ok {
+			t.Errorf("WheelIndex(%d) = %d, %v; want %d", n, i, ok, want)
+		}
+	}
+	if _, ok := WheelIndex(15); ok {
+		t.Error("15 is on the wheel")
+	}
+	if CoprimeTo210(210) || !CoprimeTo210(211) {
+		t.Error("CoprimeTo210 is wrong for 210 or 211")
+	}
+}
+
+func TestPrimeDifferences(t *testing.T) {
+	got := PrimeDifferences(2, 5)
+	want := [][]int{{2, 3, 5, 7, 11}, {1, 2, 2, 4}, {1, 0, 2}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("PrimeDifferences(2, 5) = %v, want %v", got, want)
+	}
+}
+
+func TestBloom(t *testing.T) {
+	const n, rate = 10000, 0.01
+	b := BloomUpTo(n, rate)
+	primes := eratosthenes(n)
+	for _, p := range primes {
+		if !b.MaybePrime(p) {
+			t.Fatalf("%d is prime but not in the filter", p)
+		}
+	}
+	fp := 0
+	for x := 0; x <= n; x++ {
+		if _, prime := slices.BinarySearch(primes, x); !prime && b.MaybePrime(x) {
+			fp++
+		}
+	}
+	if got := float64(fp) / float64(n+1-len(primes)); got > 2*rate {
+		t.Errorf("false positive rate %v, want about %v", got, rate)
+	}
+	for _, rate := range []float64{0, -1, 2, math.NaN()} {
+		if b := BloomUpTo(100, rate); !b.MaybePrime(97) || len(b.bits) > 1000 {
+			t.Errorf("BloomUpTo(100, %v) has %d words", rate, len(b.bits))
+		}
+	}
+}
+
+func TestDigitSumPrimes(t *testing.T) {
+	if got, want := DigitSumPrimesUpTo(2, 200), []int{2, 11, 101}; !slices.Equal(got, want) {
+		t.Errorf("DigitSumPrimesUpTo(2, 200) = %v, want %v", got, want)
+	}
+}
+
+func TestRepunitPrimes(t *testing.T) {
+	var got []int64
+	for r := range RepunitPrimes(2, 20, nil) {
+		got = append(got, r.Int64())
+	}
+	if want := []int64{3, 7, 31, 127, 8191, 131071, 524287}; !slices.Equal(got, want) {
+		t.Errorf("RepunitPrimes(2, 20) = %v, want %v", got, want)
+	}
+}
+
+func TestPairDiffs(t *testing.T) {
+	got := PairDiffs(10)
+	want := map[int]int{1: 1, 2: 4, 4: 3, 6: 1}
+	if len(got) != len(want) {
+		t.Fatalf("PairDiffs(10) = %v, want %v", got, want)
+	}
+	for g, n := range want {
+		if got[g] != n {
+			t.Errorf("PairDiffs(10) = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "primes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := WriteSortedSet(f, 10000); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 1229*8 {
+		t.Errorf("the set takes %d bytes, want %d", fi.Size(), 1229*8)
+	}
+	for x, want := range map[uint64]bool{2: true, 97: true, 9973: true, 0: false, 1: false, 91: false, 10007: false} {
+		if got := LookupInSortedSet(f, int(fi.Size()), x); got != want {
+			t.Errorf("LookupInSortedSet(%d) = %v", x, got)
+		}
+	}
+}
+
+func TestTimings(t *testing.T) {
+	for _, timed := range []bool{false, true} {
+		g, err := NewGenerator(Config{Timed: timed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 10000 {
+			g.Next()
+		}
+		g.Stop()
+		for phase, d := range g.Timings() {
+			if (d > 0) != timed {
+				t.Errorf("with Timed %v, %s took %v", timed, phase, d)
+			}
+		}
+	}
+}
+
+func TestCandidatesConfig(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	candidates := make(chan int)
+	go func() {
+		for n := 1; ; n += 6 {
+			select {
+			case candidates <- n:
+			case <-done:
+				return
+			}
+		}
+	}()
+	primes := sieve(Config{Candidates: candidates}.withDefaults(), done)
+	for _, want := range eratosthenes(10000) {
+		if want%6 == 1 {
+			if p := <-primes; p != want {
+				t.Fatalf("got %d, want %d", p, want)
+			}
+		}
+	}
+}
+
+func TestGapAutocorrelation(t *testing.T) {
+	// the gaps 1, 2, 2, 4, 2 have mean 2.2, and at lag 1
+	// (-1.2*-0.2 + -0.2*-0.2 + -0.2*1.8 + 1.8*-0.2) / 4.8 = -0.44/4.8
+	if got, want := GapAutocorrelation(1, 6), -0.44/4.8; math.Abs(got-want) > 1e-12 {
+		t.Errorf("GapAutocorrelation(1, 6) = %v, want %v", got, want)
+	}
+	if got := GapAutocorrelation(5, 6); !math.IsNaN(got) {
+		t.Errorf("GapAutocorrelation(5, 6) = %v, want NaN", got)
+	}
+}
+
+func TestTable(t *testing.T) {
+	n := goroutines()
+	var tab Table
+	primes := eratosthenes(20000)
+	size := 0
+	for _, x := range []int{100, 7, 5000, 2, 19999, 3000, 20000, 1} {
+		_, prime := slices.BinarySearch(primes, x)
+		if got := tab.Contains(x); got != prime {
+			t.Errorf("Contains(%d) = %v", x, got)
+		}
+		if got, want := tab.Below(x), primes[:sort.SearchInts(primes, x)]; !slices.Equal(got, want) {
+			t.Errorf("Below(%d) has %d primes, want %d", x, len(got), len(want))
+		}
+		if len(tab.c.ps) < size {
+			t.Errorf("the table shrank from %d to %d", size, len(tab.c.ps))
+		}
+		size = len(tab.c.ps)
+	}
+	tab.Close()
+	settles(t, n)
+	if !tab.Contains(97) {
+		t.Error("a closed Table cannot be used again")
+	}
+	tab.Close()
+	settles(t, n)
+}
+
+func TestCircularPrimes(t *testing.T) {
+	ch, stop := stoppable(func(done <-chan struct{}) chan int { return circularPrimes(nil, done) })
+	defer stop()
+	got := take(ch, 10)
+	if want := []int{2, 3, 5, 7, 11, 13, 17, 31, 37, 71}; !slices.Equal(got, want) {
+		t.Errorf("CircularPrimes() = %v, want %v", got, want)
+	}
+}
+
+func TestTruncatablePrimes(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	got := take(truncatablePrimes(true, nil, done), 10)
+	if want := []int{2, 3, 5, 7, 23, 29, 31, 37, 53, 59}; !slices.Equal(got, want) {
+		t.Errorf("TruncatablePrimes(true) = %v, want %v", got, want)
+	}
+	got = take(truncatablePrimes(false, nil, done), 10)
+	if want := []int{2, 3, 5, 7, 13, 17, 23, 37, 43, 47}; !slices.Equal(got, want) {
+		t.Errorf("TruncatablePrimes(false) = %v, want %v", got, want)
+	}
+	var right []int
+	for p := range TruncatablePrimes(true, nil) {
+		right = append(right, p)
+	}
+	if len(right) != 83 || right[82] != 73939133 {
+		t.Errorf("there are %d right-truncatable primes, the last %d", len(right), right[len(right)-1])
+	}
+}
+
+func TestSampledPrimes(t *testing.T) {
+	for _, c := range []struct {
+		upTo, stride, offset int
+		want                 []int
+	}{
+		{30, 3, 0, []int{2, 7, 17, 29}},
+		{29, 3, 0, []int{2, 7, 17}},
+		{30, 4, 1, []int{3, 13, 29}},
+		{30, 0, 0, nil},
+		{30, 1, -1, nil},
+	} {
+		if got := SampledPrimes(c.upTo, c.stride, c.offset); !slices.Equal(got, c.want) {
+			t.Errorf("SampledPrimes(%d, %d, %d) = %v, want %v", c.upTo, c.stride, c.offset, got, c.want)
+		}
+	}
+}
+
+func TestPrimeFibonacci(t *testing.T) {
+	if got, want := PrimeFibonacci(5), []int{1, 2, 5, 13, 89}; !slices.Equal(got, want) {
+		t.Errorf("PrimeFibonacci(5) = %v, want %v", got, want)
+	}
+	if got := PrimeFibonacci(100); len(got) != 24 { // F(97) overflows
+		t.Errorf("PrimeFibonacci(100) has %d values, want 24", len(got))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	var text strings.Builder
+	for _, p := range eratosthenes(100) {
+		fmt.Fprintln(&text, p)
+	}
+	h := fnv.New64a()
+	io.WriteString(h, text.String())
+	if a, b := Checksum(100), Checksum(100); a != b || a != h.Sum64() {
+		t.Errorf("Checksum(100) = %x, then %x; want %x", a, b, h.Sum64())
+	}
+
+	// and the output of the other sieve programs
+	for _, file := range []string{"sieve1.go", "sieve2.go"} {
+		h.Reset()
+		io.WriteString(h, gorun(t, file, "10000"))
+		if got := Checksum(10000); got != h.Sum64() {
+			t.Errorf("Checksum(10000) = %x, the output of %s hashes to %x", got, file, h.Sum64())
+		}
+	}
+}
+
+func TestPrimesToReachSum(t *testing.T) {
+	if ps, n := PrimesToReachSum(10); !slices.Equal(ps, []int{2, 3, 5}) || n != 3 {
+		t.Errorf("PrimesToReachSum(10) = %v, %d", ps, n)
+	}
+	if ps, n := PrimesToReachSum(1); !slices.Equal(ps, []int{2}) || n != 1 {
+		t.Errorf("PrimesToReachSum(1) = %v, %d", ps, n)
+	}
+}
+
+func TestUpToSentinel(t *testing.T) {
+	var got []int
+	for p := range UpToSentinel(10, -1) {
+		got = append(got, p)
+	}
+	if want := []int{2, 3, 5, 7, -1}; !slices.Equal(got, want) {
+		t.Errorf("UpToSentinel(10, -1) = %v, want %v", got, want)
+	}
+}
+
+func TestJumpingChampion(t *testing.T) {
+	// below 100, the gap 2 occurs 8 times, 4 and 6 7 times each
+	if got := JumpingChampion(100); got != 2 {
+		t.Errorf("JumpingChampion(100) = %d, want 2", got)
+	}
+	// below 1000, 6 occurs 44 times, 4 40 times, 2 35 times
+	if got := JumpingChampion(1000); got != 6 {
+		t.Errorf("JumpingChampion(1000) = %d, want 6", got)
+	}
+}
+
+// A PrimalityTester counting its calls to MillerRabin.
+type countingTester struct{ calls atomic.Int64 }
+
+func (c *countingTester) IsPrime(n *big.Int) bool {
+	c.calls.Add(1)
+	return MillerRabin{}.IsPrime(n)
+}
+
+func TestPrimalityTester(t *testing.T) {
+	var c countingTester
+	for range FactorialPrimes(1000000, &c) {
+	}
+	if c.calls.Load() == 0 {
+		t.Error("FactorialPrimes did not consult its tester")
+	}
+	c.calls.Store(0)
+	for range TruncatablePrimes(false, &c) {
+	}
+	if c.calls.Load() == 0 {
+		t.Error("TruncatablePrimes did not consult its tester")
+	}
+
+	primes := eratosthenes(100000)
+	for n := range 100000 {
+		_, want := slices.BinarySearch(primes, n)
+		if got := (MillerRabin{}).IsPrime(big.NewInt(int64(n))); got != want {
+			t.Fatalf("MillerRabin says %d is prime: %v", n, got)
+		}
+	}
+	// a Carmichael number and the square of the prime 2^31-1
+	for _, n := range []int64{561, 41041, 2147483647 * 2147483647} {
+		if (MillerRabin{}).IsPrime(big.NewInt(n)) {
+			t.Errorf("MillerRabin says %d is prime", n)
+		}
+	}
+}
+
+func TestTinyBuffers(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	c := Config{Bufsize: 1, CompositeBuf: 1, MultiplesBuf: 1}
+	primes := sieve(c.withDefaults(), done)
+	for i, want := range eratosthenes(10000) {
+		if p := <-primes; p != want {
+			t.Fatalf("prime %d is %d, want %d", i+1, p, want)
+		}
+	}
+}
+
+func TestLocalDensity(t *testing.T) {
+	got := take(LocalDensity(10), 6)
+	want := []windowCount{{5, 4}, {15, 4}, {25, 2}, {35, 2}, {45, 3}, {55, 2}}
+	if !slices.Equal(got, want) {
+		t.Errorf("LocalDensity(10) = %v, want %v", got, want)
+	}
+}
+
+func TestGaussianPrimes(t *testing.T) {
+	if got, want := take(GaussianInertPrimes(), 5), []int{3, 7, 11, 19, 23}; !slices.Equal(got, want) {
+		t.Errorf("GaussianInertPrimes() = %v, want %v", got, want)
+	}
+	if got, want := take(GaussianSplitPrimes(), 5), []int{2, 5, 13, 17, 29}; !slices.Equal(got, want) {
+		t.Errorf("GaussianSplitPrimes() = %v, want %v", got, want)
+	}
+}
+
+func TestBatched(t *testing.T) {
+	var got []int
+	var sizes []int
+	for b := range BatchedUpTo(100, 100000) {
+		got = append(got, b...)
+		sizes = append(sizes, len(b))
+	}
+	if want := eratosthenes(100000); !slices.Equal(got, want) {
+		t.Errorf("BatchedUpTo(100, 10^5) flattens to %d primes, want %d", len(got), len(want))
+	}
+	for i, n := range sizes[:len(sizes)-1] {
+		if n != 100 {
+			t.Errorf("batch %d has %d primes", i, n)
+		}
+	}
+}
+
+// Receiving the primes <= 10^6 one at a time, and in batches of 1024.
+func BenchmarkBatched(b *testing.B) {
+	const n = 1000000
+	b.Run("single", func(b *testing.B) { benchN(b, n, withConfig(Config{})) })
+	b.Run("batched", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			done := make(chan struct{})
+			for batch := range batched(1024, math.MaxInt, done) {
+				if batch[len(batch)-1] > n {
+					break
+				}
+			}
+			close(done)
+		}
+	})
+}
+
+func TestIndexOf(t *testing.T) {
+	var tab Table
+	defer tab.Close()
+	primes := eratosthenes(100000)
+	tab.Contains(100000)
+	for i, p := range primes {
+		if got, ok := tab.IndexOf(p); got != i+1 || !ok {
+			t.Fatalf("IndexOf(%d) = %d, %v; want %d", p, got, ok, i+1)
+		}
+	}
+	for _, x := range []int{-1, 0, 1, 9, 99999, 10000000019} {
+		if got, ok := tab.IndexOf(x); ok {
+			t.Errorf("IndexOf(%d) = %d, true", x, got)
+		}
+	}
+}
+
+// Looking up primes in a table of the primes below 10^7 by interpolation
+// and by binary search.
+func BenchmarkIndexOf(b *testing.B) {
+	var tab Table
+	defer tab.Close()
+	tab.Contains(10000000)
+	ps := tab.c.ps
+	b.Run("interpolation", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tab.IndexOf(ps[i*7919%len(ps)])
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tab.c.Lock()
+			sort.SearchInts(tab.c.ps, ps[i*7919%len(ps)])
+			tab.c.Unlock()
+		}
+	})
+}
+
+func TestPrimesUpToBelow(t *testing.T) {
+	if got, want := PrimesUpTo(7), []int{2, 3, 5, 7}; !slices.Equal(got, want) {
+		t.Errorf("PrimesUpTo(7) = %v, want %v", got, want)
+	}
+	if got, want := PrimesBelow(7), []int{2, 3, 5}; !slices.Equal(got, want) {
+		t.Errorf("PrimesBelow(7) = %v, want %v", got, want)
+	}
+	if got := PrimesUpTo(1009); got[len(got)-1] != 1009 {
+		t.Errorf("PrimesUpTo(1009) ends with %d", got[len(got)-1])
+	}
+	if got := PrimesBelow(1009); got[len(got)-1] != 997 {
+		t.Errorf("PrimesBelow(1009) ends with %d", got[len(got)-1])
+	}
+	if got := PrimesBelow(2); len(got) != 0 {
+		t.Errorf("PrimesBelow(2) = %v", got)
+	}
+}
+
+func TestGapVsExpected(t *testing.T) {
+	for i, g := range take(GapVsExpected(), 4) {
+		p := []int{2, 3, 5, 7}[i]
+		if g.Prime != p || g.Expected != math.Log(float64(p)) {
+			t.Errorf("entry %d is %+v, want Prime %d, Expected ln(%d)", i, g, p, p)
+		}
+	}
+}
+
+func TestNearestPalindromicPrime(t *testing.T) {
+	for n, want := range map[int]int{100: 101, 131: 131, 0: 2, 140: 131} {
+		if got := NearestPalindromicPrime(n); got != want {
+			t.Errorf("NearestPalindromicPrime(%d) = %d, want %d", n, got, want)
+		}
+	}
+}
+
+// Receive a value from the chan made by mk, then stop it.
+func stopEarly[T any](mk func(done <-chan struct{}) chan T) {
+	ch, stop := stoppable(mk)
+	<-ch
+	stop()
+}
+
+// Every API that stops by itself, or is stopped through done, must leave
+// no goroutine behind.  None of these use the shared cache, whose sieve
+// runs for good.
+func TestNoLeaks(t *testing.T) {
+	drain := func(ch <-chan int) {
+		for range ch {
+		}
+	}
+	mr := MillerRabin{}
+	for name, f := range map[string]func(){
+		"First":         func() { First(2000) },
+		"SampledPrimes": func() { SampledPrimes(10000, 7, 3) },
+		"Nth":           func() { Nth(2000) },
+		"NthContext":    func() { NthContext(context.Background(), 2000) },
+		"PrimesUpTo":    func() { PrimesUpTo(20000) },
+		"PiFast":        func() { PiFast(100000000) },
+		"Neighbors":     func() { Neighbors(10000) },
+		"IsPrime":       func() { IsPrime(1000003) },
+		"Factorize":     func() { Factorize(1000006) },
+		"PrimePowers":   func() { PrimePowers(10000) },
+		"Classify":      func() { Classify(8128) },
+		"GapsAtLeast":   func() { GapsAtLeast(8, 10000) },
+		"FirstGap":      func() { FirstGapOfSize(20) },
+		"Quadruplets":   func() { QuadrupletsUpTo(10000) },
+		"JumpingChamp":  func() { JumpingChampion(10000) },
+		"Checksum":      func() { Checksum(10000) },
+		"ReciprocalSum": func() { ReciprocalSum(10000) },
+		"WriteSorted":   func() { WriteSortedSet(io.Discard, 10000) },
+		"BloomUpTo":     func() { BloomUpTo(10000, 0.01) },
+		"PrimeStride":   func() { PrimeStride(10000) },
+		"Enumerated": func() {
+			for i := range Enumerated() {
+				if i == 100 {
+					break
+				}
+			}
+		},
+		"Auto":            func() { drain(Auto(10000)) },
+		"UpToSentinel":    func() { drain(UpToSentinel(10000, -1)) },
+		"FactorialPrimes": func() { drain(FactorialPrimes(1000000, mr)) },
+		"PrimorialPrimes": func() { drain(PrimorialPrimes(1000000, mr)) },
+		"Truncatable":     func() { drain(TruncatablePrimes(true, mr)) },
+		"BatchedUpTo": func() {
+			for range BatchedUpTo(100, 10000) {
+			}
+		},
+		"RepunitPrimes": func() {
+			for range RepunitPrimes(2, 100, mr) {
+			}
+		},
+
+		// and the streams, stopped after their first value
+		"Candidates":        func() { stopEarly(candidates) },
+		"Auto early":        func() { stopEarly(func(d <-chan struct{}) chan int { return auto(100000, d) }) },
+		"Gaps":              func() { stopEarly(gaps) },
+		"GapVsExpected":     func() { stopEarly(gapVsExpected) },
+		"Quadruplets early": func() { stopEarly(quadruplets) },
+		"Annotate":          func() { stopEarly(annotate) },
+		"Squares":           func() { stopEarly(squares) },
+		"Popcount":          func() { stopEarly(popcountPrimes) },
+		"Zip": func() {
+			stopEarly(func(d <-chan struct{}) chan [2]int { return zip(allPrimes(d), squares(d), d) })
+		},
+		"UpToSentinel early": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return upToSentinel(100000, -1, d) })
+		},
+		"Factorial early": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return factorialPrimes(math.MaxInt, mr, d) })
+		},
+		"Primorial early": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return primorialPrimes(math.MaxInt, mr, d) })
+		},
+		"Truncatable early": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return truncatablePrimes(false, mr, d) })
+		},
+		"Batched early": func() {
+			stopEarly(func(d <-chan struct{}) chan []int { return batched(10, math.MaxInt, d) })
+		},
+		"Repunit early": func() {
+			stopEarly(func(d <-chan struct{}) chan *big.Int { return repunitPrimes(10, 1000, mr, d) })
+		},
+		"ByIndexParity": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return byIndexParity(false, d) })
+		},
+		"Gaussian": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return gaussianPrimes(true, d) })
+		},
+		"PopcountFilter": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return popcountPrimesFilter(3, d) })
+		},
+		"DigitSum": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return digitSumPrimes(4, d) })
+		},
+		"Circular": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return circularPrimes(mr, d) })
+		},
+		"LocalDensity": func() {
+			stopEarly(func(d <-chan struct{}) chan windowCount { return localDensity(10, d) })
+		},
+		"RollingProduct": func() {
+			stopEarly(func(d <-chan struct{}) chan int { return rollingProductMod(1000, d) })
+		},
+		"ByteStream": func() {
+			done := make(chan struct{})
+			byteStream(done).Read(make([]byte, 10))
+			close(done)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			n := goroutines()
+			f()
+			settles(t, n)
+		})
+	}
+}
+
+func TestFirstGapOfSize(t *testing.T) {
+	for _, c := range []struct{ g, prime int }{{1, 2}, {2, 3}, {4, 7}, {6, 23}, {3, 0}, {0, 0}} {
+		p, found := FirstGapOfSize(c.g)
+		if p != c.prime || found != (c.prime > 0) {
+			t.Errorf("FirstGapOfSize(%d) = %d, %v; want %d", c.g, p, found, c.prime)
+		}
+	}
+}
+
+func TestTee(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "primes")
+	out, code := sieve3(t, "-tee", file, "100")
+	teed, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 || out != string(teed) || !strings.HasSuffix(out, "89\n97\n") {
+		t.Errorf("sieve3 -tee printed %q and wrote %q, exit %d", out, teed, code)
+	}
+}
+
+func TestGeometricSample(t *testing.T) {
+	if got, want := GeometricSample(10, 10, 3), []int{11, 101, 997}; !slices.Equal(got, want) {
+		t.Errorf("GeometricSample(10, 10, 3) = %v, want %v", got, want)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for n, want := range map[int]string{6: "perfect", 12: "abundant", 28: "perfect", 8: "deficient", 1: "deficient"} {
+		if got := Classify(n); got != want {
+			t.Errorf("Classify(%d) = %s, want %s", n, got, want)
+		}
+	}
+	if got, want := PerfectNumbersUpTo(10000), []int{6, 28, 496, 8128}; !slices.Equal(got, want) {
+		t.Errorf("PerfectNumbersUpTo(10000) = %v, want %v", got, want)
+	}
+}
+
+func TestAmicablePairs(t *testing.T) {
+	if got, want := AmicablePairs(300), [][2]int{{220, 284}}; !slices.Equal(got, want) {
+		t.Errorf("AmicablePairs(300) = %v, want %v", got, want)
+	}
+}
+
+func TestPrimeColorMap(t *testing.T) {
+	got := PrimeColorMap(10)
+	want := []uint32{UnitColor, UnitColor, PrimeColor, PrimeColor, CompositeColor, PrimeColor,
+		CompositeColor, PrimeColor, CompositeColor, CompositeColor, CompositeColor}
+	if !slices.Equal(got, want) {
+		t.Errorf("PrimeColorMap(10) = %x, want %x", got, want)
+	}
+	if got := PrimeColorMap(-1); len(got) != 0 {
+		t.Errorf("PrimeColorMap(-1) = %x", got)
+	}
+}
+
+// The same sieve on one thread and on GOMAXPROCS threads by default.  With
+// one CPU the two are the same; otherwise the difference is the cost, or
+// the gain, of the pipeline's goroutines running on different threads.
+func BenchmarkGOMAXPROCS(b *testing.B) {
+	for _, procs := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(strconv.Itoa(procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			benchN(b, 1000000, withConfig(Config{}))
+		})
+	}
+}
+
+func TestMaxMeritBelow(t *testing.T) {
+	// the gap of 4 after 7, then the gap of 14 after 113
+	for n, want := range map[int]int{100: 7, 1000: 113} {
+		gap := map[int]float64{7: 4, 113: 14}[want]
+		if p, m := MaxMeritBelow(n); p != want || m != gap/math.Log(float64(want)) {
+			t.Errorf("MaxMeritBelow(%d) = %d, %v; want %d", n, p, m, want)
+		}
+	}
+	if p, m := MaxMeritBelow(2); p != 0 || m != 0 {
+		t.Errorf("MaxMeritBelow(2) = %d, %v; want 0, 0", p, m)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2009 Anh Hai Trinh. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build watchdog
+
+// A deadlock watchdog for sieve3.go, for development only.  Build it in by
+// naming it on the command line:
+//
+//	go build sieve3.go watchdog.go
+//
+// and leave it out, as in `go build sieve3.go`, for any other build.  The
+// go command ignores build constraints on files named on the command line,
+// so it is leaving this file off, not the watchdog tag, that keeps it out;
+// the tag only keeps it out of builds of the whole directory.  Once built
+// in, a sieve that emits no prime for WatchdogTimeout while its output is
+// waited on dumps the stacks of all goroutines and panics.  This covers
+// every sieve, including those of SieveTo and of a Generator after Reset
+// or RestoreFrom.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"time"
+)
+
+// How long a sieve may go without emitting a prime before the watchdog
+// fires.  Time spent waiting for the receiver does not count.
+var WatchdogTimeout = 10 * time.Second
+
+func init() { watch = watchdog }
+
+// Return a chan whose values are sent on to out, panicking if none comes
+// for WatchdogTimeout.  The goroutine is counted in ps.wg and exits once
+// done is closed.
+func watchdog(out chan<- int, ps *pipes, done <-chan struct{}) chan<- int {
+	in := make(chan int, cap(out))
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTimer(WatchdogTimeout)
+		defer t.Stop()
+		for {
+			t.Reset(WatchdogTimeout)
+			select {
+			case p := <-in:
+				select {
+				case out <- p:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			case <-t.C:
+				pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+				panic(fmt.Sprintf("watchdog: no prime for %v", WatchdogTimeout))
+			}
+		}
+	}()
+	return in
+}
@@ -0,0 +1,54 @@
+// Copyright 2009 Anh Hai Trinh. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build watchdog
+
+// Tests of watchdog.go, run with
+//
+//	go test sieve3.go watchdog.go watchdog_test.go
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stall a sieve by giving it candidates that never come, in a new process
+// as the watchdog panics, and check that the watchdog fires.
+func TestWatchdogFires(t *testing.T) {
+	if os.Getenv("GOSIEVE_STALL") != "" {
+		WatchdogTimeout = 100 * time.Millisecond
+		<-sieve(Config{Candidates: make(chan int)}.withDefaults(), nil)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWatchdogFires$")
+	cmd.Env = append(os.Environ(), "GOSIEVE_STALL=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "watchdog: no prime for 100ms") {
+		t.Errorf("the stalled sieve exited with %v, printing\n%s", err, out)
+	}
+}
+
+// A sieve that keeps emitting primes, or whose receiver is slow, must not
+// set it off.
+func TestWatchdogQuiet(t *testing.T) {
+	defer func(d time.Duration) { WatchdogTimeout = d }(WatchdogTimeout)
+	WatchdogTimeout = 100 * time.Millisecond
+	g, err := NewGenerator(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	for range 100000 {
+		g.Next()
+	}
+	time.Sleep(3 * WatchdogTimeout)
+	if p := g.Next(); p != 1299721 {
+		t.Errorf("prime 100001 is %d, want 1299721", p)
+	}
+}